@@ -0,0 +1,191 @@
+package gondola
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// challengeHTTP01 is the ACME HTTP-01 challenge type.
+	challengeHTTP01 = "http-01"
+	// challengeTLSALPN01 is the ACME TLS-ALPN-01 challenge type.
+	challengeTLSALPN01 = "tls-alpn-01"
+)
+
+// defaultRenewBeforeDays is the default number of days before expiry to renew certificates.
+const defaultRenewBeforeDays = 30
+
+// acmeRetryInterval is the interval during which issuance is not retried for a host after it failed.
+const acmeRetryInterval = time.Minute
+
+// acmeManager obtains and renews certificates for upstream host names via ACME.
+type acmeManager struct {
+	manager    *autocert.Manager
+	hosts      []string
+	challenges []string
+	fallback   *certStore
+
+	mu     sync.Mutex
+	failed map[string]time.Time
+}
+
+// newACMEManager creates a new acmeManager from the given configuration.
+// It returns nil if ACME is not enabled.
+func newACMEManager(c *Config) (*acmeManager, error) {
+	ac := c.Proxy.ACME
+	if !ac.Enabled {
+		return nil, nil
+	}
+
+	challenges := ac.Challenges
+	if len(challenges) == 0 {
+		challenges = []string{challengeHTTP01, challengeTLSALPN01}
+	}
+	for _, ch := range challenges {
+		if ch != challengeHTTP01 && ch != challengeTLSALPN01 {
+			return nil, fmt.Errorf("unsupported ACME challenge type: %s", ch)
+		}
+	}
+
+	var hosts []string
+	for _, u := range c.Upstreams {
+		host := strings.ToLower(hostWithoutPort(u.HostName))
+		if !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("ACME is enabled but no upstream host name is configured")
+	}
+
+	cacheDir := ac.CacheDir
+	if cacheDir == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, fmt.Errorf("cache_dir of ACME is required: %w", err)
+		}
+		cacheDir = filepath.Join(dir, "gondola", "acme")
+	}
+
+	renewBeforeDays := ac.RenewBeforeDays
+	if renewBeforeDays <= 0 {
+		renewBeforeDays = defaultRenewBeforeDays
+	}
+
+	client := &acme.Client{
+		DirectoryURL: ac.DirectoryURL,
+	}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+	if ac.CAFile != "" {
+		pem, err := os.ReadFile(filepath.Clean(ac.CAFile))
+		if err != nil {
+			return nil, fmt.Errorf("error reading ACME CA file %s: %w", ac.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in ACME CA file %s", ac.CAFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	return &acmeManager{
+		manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       autocert.DirCache(cacheDir),
+			HostPolicy:  autocert.HostWhitelist(hosts...),
+			RenewBefore: time.Duration(renewBeforeDays) * 24 * time.Hour,
+			Client:      client,
+			Email:       ac.Email,
+		},
+		hosts:      hosts,
+		challenges: challenges,
+		failed:     make(map[string]time.Time),
+	}, nil
+}
+
+// httpHandler returns a handler that answers HTTP-01 challenges and passes other requests to next.
+func (m *acmeManager) httpHandler(next http.Handler) http.Handler {
+	if !slices.Contains(m.challenges, challengeHTTP01) {
+		return next
+	}
+	return m.manager.HTTPHandler(next)
+}
+
+// nextProtos returns the ALPN protocols of TLS listeners, adding the TLS-ALPN-01 protocol to protos if enabled.
+func (m *acmeManager) nextProtos(protos []string) []string {
+	if slices.Contains(m.challenges, challengeTLSALPN01) {
+		return append(slices.Clone(protos), acme.ALPNProto)
+	}
+	return protos
+}
+
+// GetCertificate returns the ACME certificate for the server name of the ClientHello.
+// If issuance fails, the static certificates are used as a fallback.
+// Issuance is not retried for acmeRetryInterval after it failed while a fallback is available.
+// Server names other than the upstream host names get the static certificates without asking the ACME server.
+func (m *acmeManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if m.fallback == nil || slices.Equal(hello.SupportedProtos, []string{acme.ALPNProto}) {
+		return m.manager.GetCertificate(hello)
+	}
+	name := strings.ToLower(hello.ServerName)
+	if !slices.Contains(m.hosts, name) {
+		return m.fallback.GetCertificate(hello)
+	}
+
+	m.mu.Lock()
+	failedAt, ok := m.failed[name]
+	m.mu.Unlock()
+	if ok && time.Since(failedAt) < acmeRetryInterval {
+		return m.fallback.GetCertificate(hello)
+	}
+
+	cert, err := m.manager.GetCertificate(hello)
+	if err == nil {
+		return cert, nil
+	}
+	m.mu.Lock()
+	m.failed[name] = time.Now()
+	m.mu.Unlock()
+	slog.Warn("error obtaining ACME certificate, using static certificate: "+err.Error(), slog.String("server_name", hello.ServerName))
+	return m.fallback.GetCertificate(hello)
+}
+
+// obtain obtains certificates for all host names in advance so that the first handshakes are not delayed.
+// Obtained certificates are renewed by the manager before they expire.
+func (m *acmeManager) obtain(ctx context.Context) {
+	for _, host := range m.hosts {
+		if ctx.Err() != nil {
+			return
+		}
+		hello := &tls.ClientHelloInfo{
+			ServerName:       host,
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+			SupportedPoints:  []uint8{0},
+		}
+		if _, err := m.manager.GetCertificate(hello); err != nil {
+			slog.Error("error obtaining ACME certificate: "+err.Error(), slog.String("host", host))
+			continue
+		}
+		slog.Info("ACME certificate obtained", slog.String("host", host))
+	}
+}
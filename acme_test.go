@@ -0,0 +1,447 @@
+package gondola
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestNewACMEManager(t *testing.T) {
+	tests := []struct {
+		name          string
+		acme          ACME
+		upstreams     []Upstream
+		expectedNil   bool
+		expectedError bool
+	}{
+		{
+			name:        "disabled",
+			acme:        ACME{},
+			expectedNil: true,
+		},
+		{
+			name:      "enabled",
+			acme:      ACME{Enabled: true, CacheDir: t.TempDir()},
+			upstreams: []Upstream{{HostName: "backend1.local:443", Target: "http://backend1:8081"}},
+		},
+		{
+			name:          "no upstream",
+			acme:          ACME{Enabled: true},
+			expectedError: true,
+		},
+		{
+			name:          "unsupported challenge",
+			acme:          ACME{Enabled: true, Challenges: []string{"dns-01"}},
+			upstreams:     []Upstream{{HostName: "backend1.local", Target: "http://backend1:8081"}},
+			expectedError: true,
+		},
+		{
+			name:          "missing CA file",
+			acme:          ACME{Enabled: true, CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+			upstreams:     []Upstream{{HostName: "backend1.local", Target: "http://backend1:8081"}},
+			expectedError: true,
+		},
+		{
+			name:          "invalid CA file",
+			acme:          ACME{Enabled: true, CAFile: "testdata/static/test.txt"},
+			upstreams:     []Upstream{{HostName: "backend1.local", Target: "http://backend1:8081"}},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Upstreams: tt.upstreams}
+			c.Proxy.ACME = tt.acme
+			m, err := newACMEManager(c)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tt.expectedNil != (m == nil) {
+				t.Errorf("Expected nil manager %v, got %v", tt.expectedNil, m)
+			}
+			if m != nil && !slices.Equal(m.hosts, []string{"backend1.local"}) {
+				t.Errorf("Expected hosts [backend1.local], got %v", m.hosts)
+			}
+		})
+	}
+}
+
+func TestNewACMEManagerDefaultCacheDir(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+
+	c := NewConfig(WithUpstream(Upstream{HostName: "backend1.local", Target: "http://backend1:8081"}))
+	c.Proxy.ACME = ACME{Enabled: true}
+	m, err := newACMEManager(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected, err := userConfigPath("gondola", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.manager.Cache != autocert.DirCache(expected) {
+		t.Errorf("Expected cache dir %s, got %v", expected, m.manager.Cache)
+	}
+}
+
+// userConfigPath joins elem to the user configuration directory.
+func userConfigPath(elem ...string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(append([]string{dir}, elem...)...), nil
+}
+
+func TestACMEManagerChallenges(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("next"))
+	})
+
+	tests := []struct {
+		name       string
+		challenges []string
+		protos     []string
+	}{
+		{
+			name:   "default",
+			protos: []string{"h2", "http/1.1", "acme-tls/1"},
+		},
+		{
+			name:       "http-01 only",
+			challenges: []string{challengeHTTP01},
+			protos:     []string{"h2", "http/1.1"},
+		},
+		{
+			name:       "tls-alpn-01 only",
+			challenges: []string{challengeTLSALPN01},
+			protos:     []string{"h2", "http/1.1", "acme-tls/1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewConfig(WithUpstream(Upstream{HostName: "backend1.local", Target: "http://backend1:8081"}))
+			c.Proxy.ACME = ACME{Enabled: true, CacheDir: t.TempDir(), Challenges: tt.challenges}
+			m, err := newACMEManager(c)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if protos := m.nextProtos([]string{"h2", "http/1.1"}); !slices.Equal(protos, tt.protos) {
+				t.Errorf("Expected protos %v, got %v", tt.protos, protos)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://backend1.local/", nil)
+			w := httptest.NewRecorder()
+			m.httpHandler(next).ServeHTTP(w, req)
+			if w.Body.String() != "next" {
+				t.Errorf("Expected body next, got %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestACMEManagerFallback(t *testing.T) {
+	directory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer directory.Close()
+
+	dir := t.TempDir()
+	certPath, keyPath := writeCertificate(t, dir, "static", time.Now().Add(time.Hour), "backend1.local")
+
+	c := NewConfig(
+		WithTLS(certPath, keyPath),
+		WithUpstream(Upstream{HostName: "backend1.local", Target: "http://backend1:8081"}),
+	)
+	c.Proxy.ACME = ACME{Enabled: true, CacheDir: t.TempDir(), DirectoryURL: directory.URL}
+	m, err := newACMEManager(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	hello := &tls.ClientHelloInfo{ServerName: "backend1.local"}
+	if _, err := m.GetCertificate(hello); err == nil {
+		t.Error("Expected error without fallback but got none")
+	}
+
+	m.fallback, err = newCertStore(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cert, err := m.GetCertificate(hello)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cert.Leaf.Subject.CommonName != "static" {
+		t.Errorf("Expected static certificate, got %s", cert.Leaf.Subject.CommonName)
+	}
+
+	// Other server names get the static certificate without being recorded.
+	for i := range 100 {
+		cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown" + strconv.Itoa(i) + ".local"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cert.Leaf.Subject.CommonName != "static" {
+			t.Errorf("Expected static certificate, got %s", cert.Leaf.Subject.CommonName)
+		}
+	}
+	if len(m.failed) != 1 {
+		t.Errorf("Expected only the failure of backend1.local to be recorded, got %d", len(m.failed))
+	}
+}
+
+// acmeServer is an in-process ACME server that issues certificates after an HTTP-01 challenge is validated by validate.
+type acmeServer struct {
+	*httptest.Server
+	ca       *x509.Certificate
+	caKey    *ecdsa.PrivateKey
+	validate func(token string) (string, error)
+
+	mu     sync.Mutex
+	host   string
+	status map[string]string // status of the order, authorization and challenge
+	cert   []byte
+}
+
+// newACMEServer starts an ACME server with its own CA.
+func newACMEServer(t *testing.T) *acmeServer {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "acme test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &acmeServer{ca: ca, caKey: caKey, status: make(map[string]string)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *acmeServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", base64.RawURLEncoding.EncodeToString([]byte(time.Now().String())))
+	if r.URL.Path == "/directory" {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   s.URL + "/nonce",
+			"newAccount": s.URL + "/account",
+			"newOrder":   s.URL + "/order",
+		})
+		return
+	}
+	if r.Method != http.MethodPost {
+		return // new nonce
+	}
+
+	// Signatures of the JWS requests are not verified.
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.URL.Path {
+	case "/account":
+		w.Header().Set("Location", s.URL+"/account/1")
+		writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+	case "/order":
+		var req struct {
+			Identifiers []struct{ Value string } `json:"identifiers"`
+		}
+		if err := json.Unmarshal(payload, &req); err != nil || len(req.Identifiers) != 1 {
+			http.Error(w, "invalid order", http.StatusBadRequest)
+			return
+		}
+		s.host = req.Identifiers[0].Value
+		s.status = map[string]string{"order": "pending", "authz": "pending", "challenge": "pending"}
+		w.Header().Set("Location", s.URL+"/order/1")
+		writeJSON(w, http.StatusCreated, s.order())
+	case "/order/1":
+		w.Header().Set("Location", s.URL+"/order/1")
+		writeJSON(w, http.StatusOK, s.order())
+	case "/authz/1":
+		writeJSON(w, http.StatusOK, map[string]any{
+			"identifier": map[string]string{"type": "dns", "value": s.host},
+			"status":     s.status["authz"],
+			"challenges": []any{s.challenge()},
+		})
+	case "/challenge/1":
+		keyAuth, err := s.validate("token1")
+		if err != nil || !strings.HasPrefix(keyAuth, "token1.") {
+			s.status["challenge"], s.status["authz"], s.status["order"] = "invalid", "invalid", "invalid"
+		} else {
+			s.status["challenge"], s.status["authz"], s.status["order"] = "valid", "valid", "ready"
+		}
+		writeJSON(w, http.StatusOK, s.challenge())
+	case "/finalize/1":
+		if s.status["order"] != "ready" {
+			http.Error(w, "order is not ready", http.StatusForbidden)
+			return
+		}
+		if err := s.issue(payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.status["order"] = "valid"
+		w.Header().Set("Location", s.URL+"/order/1")
+		writeJSON(w, http.StatusOK, s.order())
+	case "/certificate/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: s.cert})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: s.ca.Raw})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *acmeServer) order() map[string]any {
+	o := map[string]any{
+		"status":         s.status["order"],
+		"identifiers":    []any{map[string]string{"type": "dns", "value": s.host}},
+		"authorizations": []string{s.URL + "/authz/1"},
+		"finalize":       s.URL + "/finalize/1",
+	}
+	if s.status["order"] == "valid" {
+		o["certificate"] = s.URL + "/certificate/1"
+	}
+	return o
+}
+
+func (s *acmeServer) challenge() map[string]string {
+	return map[string]string{"type": "http-01", "url": s.URL + "/challenge/1", "token": "token1", "status": s.status["challenge"]}
+}
+
+// issue signs the certificate of the CSR in the finalize payload.
+func (s *acmeServer) issue(payload []byte) error {
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return err
+	}
+	der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: s.host},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	s.cert, err = x509.CreateCertificate(rand.Reader, tmpl, s.ca, csr.PublicKey, s.caKey)
+	return err
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestACMEManagerObtain(t *testing.T) {
+	s := newACMEServer(t)
+	cacheDir := t.TempDir()
+	c := NewConfig(WithUpstream(Upstream{HostName: "backend1.local", Target: "http://backend1:8081"}))
+	c.Proxy.ACME = ACME{Enabled: true, CacheDir: cacheDir, DirectoryURL: s.URL + "/directory", Challenges: []string{challengeHTTP01}}
+	m, err := newACMEManager(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The challenge is validated against the HTTP-01 handler of the proxy.
+	handler := m.httpHandler(http.NotFoundHandler())
+	s.validate = func(token string) (string, error) {
+		req := httptest.NewRequest(http.MethodGet, "http://backend1.local/.well-known/acme-challenge/"+token, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		body, err := io.ReadAll(w.Body)
+		return string(body), err
+	}
+
+	m.obtain(context.Background())
+
+	hello := &tls.ClientHelloInfo{
+		ServerName:       "backend1.local",
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		SupportedPoints:  []uint8{0},
+	}
+	cert, err := m.GetCertificate(hello)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Issuer.CommonName != "acme test CA" || !slices.Equal(leaf.DNSNames, []string{"backend1.local"}) {
+		t.Errorf("Expected certificate for backend1.local issued by the test CA, got %v issued by %s", leaf.DNSNames, leaf.Issuer)
+	}
+	if _, err := autocert.DirCache(cacheDir).Get(context.Background(), "backend1.local"); err != nil {
+		t.Errorf("Expected certificate to be cached: %v", err)
+	}
+}
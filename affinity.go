@@ -0,0 +1,218 @@
+package gondola
+
+import (
+	"cmp"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// affinityCookie sets a signed cookie naming the target that served the client.
+	affinityCookie = "cookie"
+	// affinityHash maps a key of the request to a target by consistent hashing.
+	affinityHash = "hash"
+
+	hashOnClientIP = "client_ip"
+	hashOnHeader   = "header"
+	hashOnCookie   = "cookie"
+
+	defaultAffinityCookieName = "gondola_affinity"
+
+	// affinityRingReplicas is the number of points of each target on the hash ring.
+	affinityRingReplicas = 160
+	// affinitySignatureSize is the number of bytes of the HMAC kept in the cookie.
+	affinitySignatureSize = 16
+)
+
+// affinity is the parsed session affinity configuration of an upstream.
+type affinity struct {
+	kind       string
+	cookieName string
+	maxAge     int
+	secret     []byte
+	hashOn     string
+	hashKey    string
+
+	// ring and byID are built from the targets of the pool, and replaced when the targets change.
+	mu   sync.RWMutex
+	ring []ringPoint
+	byID map[string]*upstreamTarget
+}
+
+// ringPoint is a point of a target on the hash ring.
+type ringPoint struct {
+	hash   uint64
+	target *upstreamTarget
+}
+
+// newAffinity validates the session affinity configuration and returns nil if it is disabled.
+func newAffinity(c Affinity) (*affinity, error) {
+	a := &affinity{
+		kind:       c.Type,
+		cookieName: c.CookieName,
+		maxAge:     c.CookieMaxAge,
+		secret:     []byte(c.CookieSecret),
+		hashOn:     c.HashOn,
+		hashKey:    c.HashKey,
+	}
+	switch c.Type {
+	case "":
+		return nil, nil
+	case affinityCookie:
+		if a.cookieName == "" {
+			a.cookieName = defaultAffinityCookieName
+		}
+		if a.maxAge < 0 {
+			return nil, errors.New("cookie_max_age must not be negative")
+		}
+		if len(a.secret) == 0 {
+			// Cookies signed with a random secret are not valid after a restart.
+			a.secret = make([]byte, 32)
+			if _, err := rand.Read(a.secret); err != nil {
+				return nil, fmt.Errorf("error generating cookie secret: %w", err)
+			}
+		}
+	case affinityHash:
+		switch c.HashOn {
+		case hashOnClientIP:
+		case hashOnHeader, hashOnCookie:
+			if c.HashKey == "" {
+				return nil, fmt.Errorf("hash_key must be set to hash on %s", c.HashOn)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported hash_on: %q", c.HashOn)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type: %s", c.Type)
+	}
+	return a, nil
+}
+
+// hashString returns a 64-bit hash of s that is stable across restarts and well distributed for similar strings.
+func hashString(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// targetID returns the identifier of a target used in affinity cookies, which does not reveal its address.
+func targetID(t *upstreamTarget) string {
+	return strconv.FormatUint(hashString(t.name), 36)
+}
+
+// build creates the hash ring and the cookie identifiers of the targets.
+func (a *affinity) build(targets []*upstreamTarget) {
+	byID := make(map[string]*upstreamTarget, len(targets))
+	ring := make([]ringPoint, 0, len(targets)*affinityRingReplicas)
+	for _, t := range targets {
+		byID[targetID(t)] = t
+		for i := range affinityRingReplicas {
+			ring = append(ring, ringPoint{hash: hashString(t.name + "#" + strconv.Itoa(i)), target: t})
+		}
+	}
+	slices.SortFunc(ring, func(x, y ringPoint) int {
+		return cmp.Compare(x.hash, y.hash)
+	})
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.byID = byID
+	a.ring = ring
+}
+
+// sign returns the signature of a target identifier.
+func (a *affinity) sign(id string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:affinitySignatureSize])
+}
+
+// cookieTarget returns the target named by a valid affinity cookie of the request.
+func (a *affinity) cookieTarget(r *http.Request) *upstreamTarget {
+	c, err := r.Cookie(a.cookieName)
+	if err != nil {
+		return nil
+	}
+	id, sig, ok := strings.Cut(c.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(a.sign(id))) {
+		return nil
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.byID[id]
+}
+
+// key returns the value of the request that is hashed, or an empty string if it has none.
+func (a *affinity) key(r *http.Request) string {
+	switch a.hashOn {
+	case hashOnClientIP:
+		return hostWithoutPort(r.RemoteAddr)
+	case hashOnHeader:
+		return r.Header.Get(a.hashKey)
+	case hashOnCookie:
+		if c, err := r.Cookie(a.hashKey); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// target returns the target that the request has affinity with, walking the hash ring past targets that are not usable.
+// Only the requests of an unusable target are mapped to other targets.
+func (a *affinity) target(r *http.Request, usable func(*upstreamTarget) bool) *upstreamTarget {
+	if a.kind == affinityCookie {
+		if t := a.cookieTarget(r); t != nil && usable(t) {
+			return t
+		}
+		return nil
+	}
+
+	a.mu.RLock()
+	ring := a.ring
+	a.mu.RUnlock()
+	k := a.key(r)
+	if k == "" || len(ring) == 0 {
+		return nil
+	}
+	h := hashString(k)
+	i, _ := slices.BinarySearchFunc(ring, h, func(p ringPoint, h uint64) int {
+		return cmp.Compare(p.hash, h)
+	})
+	for j := range ring {
+		if t := ring[(i+j)%len(ring)].target; usable(t) {
+			return t
+		}
+	}
+	return nil
+}
+
+// setCookie adds the affinity cookie of the target to the response unless the request already has it.
+func (a *affinity) setCookie(r *http.Request, resp *http.Response, t *upstreamTarget) {
+	if a.kind != affinityCookie || a.cookieTarget(r) == t {
+		return
+	}
+	id := targetID(t)
+	c := &http.Cookie{
+		Name:     a.cookieName,
+		Value:    id + "." + a.sign(id),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if a.maxAge > 0 {
+		c.MaxAge = a.maxAge
+		c.Expires = time.Now().Add(time.Duration(a.maxAge) * time.Second)
+	}
+	resp.Header.Add("Set-Cookie", c.String())
+}
@@ -0,0 +1,209 @@
+package gondola
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestNewAffinity(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        Affinity
+		expected      *affinity
+		expectedError bool
+	}{
+		{name: "disabled", config: Affinity{}},
+		{
+			name:     "cookie",
+			config:   Affinity{Type: "cookie", CookieSecret: "secret"},
+			expected: &affinity{kind: affinityCookie, cookieName: defaultAffinityCookieName, secret: []byte("secret")},
+		},
+		{
+			name:     "hash on header",
+			config:   Affinity{Type: "hash", HashOn: "header", HashKey: "X-User-ID"},
+			expected: &affinity{kind: affinityHash, hashOn: hashOnHeader, hashKey: "X-User-ID"},
+		},
+		{name: "unsupported type", config: Affinity{Type: "ip"}, expectedError: true},
+		{name: "unsupported hash on", config: Affinity{Type: "hash", HashOn: "path"}, expectedError: true},
+		{name: "hash on cookie without key", config: Affinity{Type: "hash", HashOn: "cookie"}, expectedError: true},
+		{name: "negative cookie max age", config: Affinity{Type: "cookie", CookieMaxAge: -1}, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := newAffinity(tt.config)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tt.expected == nil {
+				if actual != nil {
+					t.Errorf("Expected affinity to be disabled, got %+v", actual)
+				}
+				return
+			}
+			if actual.kind != tt.expected.kind || actual.cookieName != tt.expected.cookieName || string(actual.secret) != string(tt.expected.secret) ||
+				actual.hashOn != tt.expected.hashOn || actual.hashKey != tt.expected.hashKey {
+				t.Errorf("Expected %+v, got %+v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+// newAffinityPool creates a pool of three named backends with the given affinity.
+func newAffinityPool(t *testing.T, a Affinity) *targetPool {
+	t.Helper()
+	var targets []string
+	for i := range 3 {
+		targets = append(targets, newStatusServer(t, "backend"+strconv.Itoa(i), http.StatusOK).URL)
+	}
+	p, err := newTargetPool(Upstream{HostName: "backend.local", Targets: targets, Affinity: a}, nil, slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// roundTripWith sends a request modified by fn through the pool and returns the name of the backend and the response.
+func roundTripWith(t *testing.T, p *targetPool, fn func(r *http.Request)) (string, *http.Response) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+	fn(req)
+	res, err := p.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	return string(body), res
+}
+
+func TestCookieAffinity(t *testing.T) {
+	p := newAffinityPool(t, Affinity{Type: "cookie", CookieSecret: "secret", CookieMaxAge: 3600})
+
+	name, res := roundTripWith(t, p, func(r *http.Request) {})
+	cookies := res.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != defaultAffinityCookieName || !cookies[0].HttpOnly || cookies[0].MaxAge != 3600 {
+		t.Fatalf("Expected an affinity cookie, got %v", res.Header.Values("Set-Cookie"))
+	}
+	cookie := cookies[0]
+
+	for range 5 {
+		actual, res := roundTripWith(t, p, func(r *http.Request) { r.AddCookie(cookie) })
+		if actual != name {
+			t.Errorf("Expected requests with the cookie to go to %s, got %s", name, actual)
+		}
+		if len(res.Cookies()) != 0 {
+			t.Errorf("Expected no cookie to be set again, got %v", res.Header.Values("Set-Cookie"))
+		}
+	}
+
+	tampered := &http.Cookie{Name: cookie.Name, Value: cookie.Value + "x"}
+	if _, res := roundTripWith(t, p, func(r *http.Request) { r.AddCookie(tampered) }); len(res.Cookies()) != 1 {
+		t.Error("Expected a tampered cookie to be replaced")
+	}
+
+	// Requests of an ejected target move to another target, which is named by a new cookie.
+	for _, target := range p.targets {
+		if targetID(target)+"."+p.affinity.sign(targetID(target)) == cookie.Value {
+			target.health.ejected = true
+		}
+	}
+	actual, res := roundTripWith(t, p, func(r *http.Request) { r.AddCookie(cookie) })
+	if actual == name {
+		t.Errorf("Expected requests to move from the ejected target %s", name)
+	}
+	if len(res.Cookies()) != 1 || res.Cookies()[0].Value == cookie.Value {
+		t.Errorf("Expected a new cookie naming the other target, got %v", res.Header.Values("Set-Cookie"))
+	}
+}
+
+func TestAffinityWithDiscovery(t *testing.T) {
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	defer slog.SetDefault(prev)
+
+	tests := []struct {
+		name     string
+		affinity Affinity
+	}{
+		{name: "cookie", affinity: Affinity{Type: "cookie", CookieSecret: "secret"}},
+		{name: "hash", affinity: Affinity{Type: "hash", HashOn: "header", HashKey: "X-User-ID"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newAffinityPool(t, tt.affinity)
+			all := make([]string, 0, len(p.targets))
+			for _, target := range p.targets {
+				all = append(all, target.name)
+			}
+			_, res := roundTripWith(t, p, func(r *http.Request) {})
+			cookies := res.Cookies()
+
+			// Targets change while requests with affinity are sent.
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := range 50 {
+					if err := p.setTargets(all[:len(all)-i%2]); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+			for i := range 50 {
+				roundTripWith(t, p, func(r *http.Request) {
+					for _, c := range cookies {
+						r.AddCookie(c)
+					}
+					r.Header.Set("X-User-ID", "user"+strconv.Itoa(i))
+				})
+			}
+			<-done
+		})
+	}
+}
+
+func TestHashAffinity(t *testing.T) {
+	p := newAffinityPool(t, Affinity{Type: "hash", HashOn: "header", HashKey: "X-User-ID"})
+
+	byUser := make(map[string]string)
+	for i := range 30 {
+		user := "user" + strconv.Itoa(i)
+		name, _ := roundTripWith(t, p, func(r *http.Request) { r.Header.Set("X-User-ID", user) })
+		byUser[user] = name
+	}
+	used := make(map[string]bool)
+	for user, name := range byUser {
+		used[name] = true
+		if actual, _ := roundTripWith(t, p, func(r *http.Request) { r.Header.Set("X-User-ID", user) }); actual != name {
+			t.Errorf("Expected %s to stay on %s, got %s", user, name, actual)
+		}
+	}
+	if len(used) != len(p.targets) {
+		t.Errorf("Expected users to be spread across %d targets, got %v", len(p.targets), used)
+	}
+
+	// Only the users of an ejected target are mapped to other targets.
+	p.targets[0].health.ejected = true
+	ejectedName := "backend0"
+	for user, name := range byUser {
+		actual, _ := roundTripWith(t, p, func(r *http.Request) { r.Header.Set("X-User-ID", user) })
+		if name == ejectedName && actual == ejectedName {
+			t.Errorf("Expected %s to move from the ejected target", user)
+		}
+		if name != ejectedName && actual != name {
+			t.Errorf("Expected %s to stay on %s, got %s", user, name, actual)
+		}
+	}
+}
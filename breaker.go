@@ -0,0 +1,233 @@
+package gondola
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultCircuitMinRequests      = 20
+	defaultCircuitWindow           = 10 * time.Second
+	defaultCircuitOpenDuration     = 30 * time.Second
+	defaultCircuitHalfOpenRequests = 1
+)
+
+// circuitState is the state of the circuit breaker of a target.
+type circuitState int
+
+const (
+	// circuitClosed lets requests through.
+	circuitClosed circuitState = iota
+	// circuitOpen rejects requests until the open duration has passed.
+	circuitOpen
+	// circuitHalfOpen lets a limited number of probe requests through to decide whether to close the circuit.
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker is the parsed circuit breaker configuration of an upstream.
+type circuitBreaker struct {
+	errorRate        int
+	latencyThreshold time.Duration
+	minRequests      int
+	window           time.Duration
+	openDuration     time.Duration
+	halfOpenRequests int
+}
+
+// newCircuitBreaker validates the circuit breaker configuration and returns nil if it is disabled.
+func newCircuitBreaker(c CircuitBreaker) (*circuitBreaker, error) {
+	if c.ErrorRate < 0 || c.LatencyThreshold < 0 || c.MinRequests < 0 || c.Window < 0 || c.OpenDuration < 0 || c.HalfOpenRequests < 0 {
+		return nil, errors.New("values must not be negative")
+	}
+	if c.ErrorRate > 100 {
+		return nil, errors.New("error_rate must not be greater than 100")
+	}
+	if c.ErrorRate == 0 {
+		if c.LatencyThreshold > 0 {
+			return nil, errors.New("error_rate must be set to use latency_threshold")
+		}
+		return nil, nil
+	}
+
+	cb := &circuitBreaker{
+		errorRate:        c.ErrorRate,
+		latencyThreshold: time.Duration(c.LatencyThreshold) * time.Millisecond,
+		minRequests:      c.MinRequests,
+		window:           time.Duration(c.Window) * time.Millisecond,
+		openDuration:     time.Duration(c.OpenDuration) * time.Millisecond,
+		halfOpenRequests: c.HalfOpenRequests,
+	}
+	if cb.minRequests == 0 {
+		cb.minRequests = defaultCircuitMinRequests
+	}
+	if cb.window == 0 {
+		cb.window = defaultCircuitWindow
+	}
+	if cb.openDuration == 0 {
+		cb.openDuration = defaultCircuitOpenDuration
+	}
+	if cb.halfOpenRequests == 0 {
+		cb.halfOpenRequests = defaultCircuitHalfOpenRequests
+	}
+	return cb, nil
+}
+
+// targetCircuit is the circuit breaker state of an upstream target.
+type targetCircuit struct {
+	state       circuitState
+	windowStart time.Time
+	requests    int // requests in the current window, or probes succeeded while half-open
+	failures    int
+	openUntil   time.Time
+	probes      int // probe requests in flight while half-open
+}
+
+// circuitOpenError is returned when the circuits of all targets of an upstream are open.
+type circuitOpenError struct {
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return "circuit breaker is open for all targets"
+}
+
+// writeCircuitOpen responds with 503 and a Retry-After header of the seconds until a circuit becomes half-open.
+func writeCircuitOpen(w http.ResponseWriter, e *circuitOpenError) {
+	seconds := max(1, int(math.Ceil(e.retryAfter.Seconds())))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
+// circuitAllows returns true if the circuit of the target lets a request through. The caller must hold p.mu.
+func (p *targetPool) circuitAllows(t *upstreamTarget, now time.Time) bool {
+	cb := p.breaker
+	if cb == nil {
+		return true
+	}
+	c := &t.circuit
+	switch c.state {
+	case circuitOpen:
+		return !now.Before(c.openUntil) && c.probes < cb.halfOpenRequests
+	case circuitHalfOpen:
+		return c.probes < cb.halfOpenRequests
+	default:
+		return true
+	}
+}
+
+// acquireCircuit counts a request let through the circuit of the target, which becomes half-open once its open duration has passed.
+// The caller must hold p.mu.
+func (p *targetPool) acquireCircuit(t *upstreamTarget) {
+	if p.breaker == nil {
+		return
+	}
+	c := &t.circuit
+	if c.state == circuitOpen {
+		p.setCircuit(t, circuitHalfOpen)
+	}
+	if c.state == circuitHalfOpen {
+		c.probes++
+	}
+}
+
+// recordCircuit records the result of an attempt to the target and opens or closes its circuit.
+// Slow responses beyond latency_threshold count as failures. The caller must hold p.mu.
+func (p *targetPool) recordCircuit(t *upstreamTarget, failed bool, elapsed time.Duration, now time.Time) {
+	cb := p.breaker
+	if cb == nil {
+		return
+	}
+	if cb.latencyThreshold > 0 && elapsed > cb.latencyThreshold {
+		failed = true
+	}
+
+	c := &t.circuit
+	switch c.state {
+	case circuitOpen:
+		// The attempt was let through before the circuit opened.
+	case circuitHalfOpen:
+		c.probes--
+		if failed {
+			c.failures++
+			p.openCircuit(t, now)
+			return
+		}
+		c.requests++
+		if c.requests >= cb.halfOpenRequests {
+			p.setCircuit(t, circuitClosed)
+			p.warmUp(t, now)
+		}
+	default:
+		if now.Sub(c.windowStart) >= cb.window {
+			c.windowStart = now
+			c.requests = 0
+			c.failures = 0
+		}
+		c.requests++
+		if failed {
+			c.failures++
+		}
+		if c.requests >= cb.minRequests && c.failures*100 >= cb.errorRate*c.requests {
+			p.openCircuit(t, now)
+		}
+	}
+}
+
+// openCircuit opens the circuit of the target for the open duration. The caller must hold p.mu.
+func (p *targetPool) openCircuit(t *upstreamTarget, now time.Time) {
+	t.circuit.openUntil = now.Add(p.breaker.openDuration)
+	p.setCircuit(t, circuitOpen)
+}
+
+// setCircuit changes the state of the circuit of the target and logs it. The caller must hold p.mu.
+func (p *targetPool) setCircuit(t *upstreamTarget, state circuitState) {
+	c := &t.circuit
+	attrs := []any{
+		slog.String("host_name", p.hostName),
+		slog.String("target", t.name),
+		slog.String("state", state.String()),
+	}
+	level := slog.LevelInfo
+	if state == circuitOpen {
+		level = slog.LevelWarn
+		attrs = append(attrs,
+			slog.Int("requests", c.requests),
+			slog.Int("failures", c.failures),
+			slog.Float64("open_duration", p.breaker.openDuration.Seconds()),
+		)
+	}
+	slog.Log(context.Background(), level, "circuit_breaker", attrs...)
+
+	c.state = state
+	c.requests = 0
+	c.failures = 0
+	c.probes = 0
+	c.windowStart = time.Time{}
+}
+
+// circuitRetryAfter returns the time until the first open circuit of the pool becomes half-open. The caller must hold p.mu.
+func (p *targetPool) circuitRetryAfter(now time.Time) time.Duration {
+	var d time.Duration
+	for i, t := range p.targets {
+		if left := t.circuit.openUntil.Sub(now); i == 0 || left < d {
+			d = left
+		}
+	}
+	return d
+}
@@ -0,0 +1,181 @@
+package gondola
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewCircuitBreaker(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        CircuitBreaker
+		expected      *circuitBreaker
+		expectedError bool
+	}{
+		{name: "disabled", config: CircuitBreaker{}},
+		{
+			name:   "defaults",
+			config: CircuitBreaker{ErrorRate: 50},
+			expected: &circuitBreaker{
+				errorRate:        50,
+				minRequests:      defaultCircuitMinRequests,
+				window:           defaultCircuitWindow,
+				openDuration:     defaultCircuitOpenDuration,
+				halfOpenRequests: defaultCircuitHalfOpenRequests,
+			},
+		},
+		{
+			name:   "custom",
+			config: CircuitBreaker{ErrorRate: 100, LatencyThreshold: 500, MinRequests: 5, Window: 1000, OpenDuration: 2000, HalfOpenRequests: 3},
+			expected: &circuitBreaker{
+				errorRate:        100,
+				latencyThreshold: 500 * time.Millisecond,
+				minRequests:      5,
+				window:           time.Second,
+				openDuration:     2 * time.Second,
+				halfOpenRequests: 3,
+			},
+		},
+		{name: "negative", config: CircuitBreaker{ErrorRate: 50, Window: -1}, expectedError: true},
+		{name: "error rate over 100", config: CircuitBreaker{ErrorRate: 101}, expectedError: true},
+		{name: "latency threshold without error rate", config: CircuitBreaker{LatencyThreshold: 500}, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := newCircuitBreaker(tt.config)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tt.expected == nil {
+				if actual != nil {
+					t.Errorf("Expected circuit breaker to be disabled, got %+v", actual)
+				}
+				return
+			}
+			if *actual != *tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+// newUpstreamProxy starts a proxy to the upstream and returns a function that sends a request through it.
+func newUpstreamProxy(t *testing.T, u Upstream) func() *http.Response {
+	t.Helper()
+	u.HostName = "backend.local"
+	us, err := newUpstream(NewConfig(WithUpstream(u)), u, nil, slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(us)
+	t.Cleanup(proxy.Close)
+
+	return func() *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "backend.local"
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		return res
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var logs syncBuffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	defer slog.SetDefault(prev)
+
+	var failing atomic.Bool
+	failing.Store(true)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+
+	do := newUpstreamProxy(t, Upstream{
+		Target:         backend.URL,
+		CircuitBreaker: CircuitBreaker{ErrorRate: 50, MinRequests: 2, OpenDuration: 300},
+	})
+
+	for range 2 {
+		if res := do(); res.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("Expected status 500 before the circuit opens, got %d", res.StatusCode)
+		}
+	}
+	res := do()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 while the circuit is open, got %d", res.StatusCode)
+	}
+	if v := res.Header.Get("Retry-After"); v != "1" {
+		t.Errorf("Expected Retry-After 1, got %q", v)
+	}
+	if !strings.Contains(logs.String(), `"state":"open"`) {
+		t.Errorf("Expected circuit open log, got %s", logs.String())
+	}
+
+	failing.Store(false)
+	time.Sleep(400 * time.Millisecond)
+	if res := do(); res.StatusCode != http.StatusOK {
+		t.Errorf("Expected the half-open probe to succeed, got %d", res.StatusCode)
+	}
+	for _, state := range []string{"half_open", "closed"} {
+		if !strings.Contains(logs.String(), `"state":"`+state+`"`) {
+			t.Errorf("Expected circuit %s log, got %s", state, logs.String())
+		}
+	}
+	if res := do(); res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 once the circuit is closed, got %d", res.StatusCode)
+	}
+}
+
+func TestCircuitBreakerLatency(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	fast := newStatusServer(t, "fast", http.StatusOK)
+
+	p, err := newTargetPool(Upstream{
+		HostName:       "backend.local",
+		Targets:        []string{slow.URL, fast.URL},
+		CircuitBreaker: CircuitBreaker{ErrorRate: 100, LatencyThreshold: 10, MinRequests: 1},
+	}, nil, slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := roundTripNames(t, p, 6)
+	if names[0] != "slow" {
+		t.Fatalf("Expected the first request to go to the slow target, got %s", names[0])
+	}
+	for _, name := range names[1:] {
+		if name != "fast" {
+			t.Errorf("Expected requests to avoid the slow target with an open circuit, got %v", names)
+			break
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package gondola
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultExpiryWarningDays is the default number of days before expiry from which a warning is logged.
+const defaultExpiryWarningDays = 30
+
+// expiryCheckInterval is the interval to check certificates for approaching expiry.
+const expiryCheckInterval = 24 * time.Hour
+
+// defaultReloadInterval is the default interval to check certificate files for changes.
+const defaultReloadInterval = 10 * time.Second
+
+// certSet is an immutable set of certificates selected by SNI.
+type certSet struct {
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+	certs    []*tls.Certificate
+	modTimes map[string]time.Time
+}
+
+// certStore holds the current certificate set and swaps it atomically when certificate files change.
+type certStore struct {
+	config  *Config
+	current atomic.Pointer[certSet]
+}
+
+// newCertStore loads the certificates configured for the proxy server and its upstreams.
+// When certificates other than the default one are configured, every upstream host name must be covered by a certificate.
+func newCertStore(c *Config) (*certStore, error) {
+	set, err := loadCertSet(c)
+	if err != nil {
+		return nil, err
+	}
+	s := &certStore{config: c}
+	s.current.Store(set)
+	s.checkExpiry()
+	return s, nil
+}
+
+// loadCertSet loads a new certificate set from the configured files.
+func loadCertSet(c *Config) (*certSet, error) {
+	s := &certSet{
+		byName:   make(map[string]*tls.Certificate),
+		modTimes: make(map[string]time.Time),
+	}
+
+	if c.Proxy.TLS.CertDir != "" {
+		fi, err := os.Stat(c.Proxy.TLS.CertDir)
+		if err != nil {
+			return nil, fmt.Errorf("error reading certificate directory %s: %w", c.Proxy.TLS.CertDir, err)
+		}
+		s.modTimes[c.Proxy.TLS.CertDir] = fi.ModTime()
+	}
+
+	if c.Proxy.TLSCertPath != "" && c.Proxy.TLSKeyPath != "" {
+		cert, err := s.add(c.Proxy.TLSCertPath, c.Proxy.TLSKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		s.fallback = cert
+	}
+
+	pairs, err := certificatePairs(c)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pairs {
+		cert, err := s.add(p.CertPath, p.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+		if s.fallback == nil {
+			s.fallback = cert
+		}
+	}
+
+	if s.fallback == nil {
+		return nil, errors.New("no certificate is configured")
+	}
+
+	// With ACME, certificates are obtained for every upstream host, so static certificates need not cover them.
+	if len(pairs) > 0 && !c.Proxy.ACME.Enabled {
+		for _, u := range c.Upstreams {
+			if !s.covers(u.HostName) {
+				return nil, fmt.Errorf("no certificate covers upstream host %s", u.HostName)
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// validateCertificates loads the certificates to report missing files and upstream hosts without a covering certificate
+// before the proxy server starts. The default certificate alone is loaded when the server starts.
+func validateCertificates(c *Config) error {
+	pairs, err := certificatePairs(c)
+	if err != nil || len(pairs) == 0 {
+		return err
+	}
+	_, err = loadCertSet(c)
+	return err
+}
+
+// certificatePairs returns the certificate and key pairs configured in addition to the default certificate.
+func certificatePairs(c *Config) ([]Certificate, error) {
+	pairs := append([]Certificate{}, c.Proxy.TLS.Certificates...)
+	for _, u := range c.Upstreams {
+		if u.TLSCertPath != "" && u.TLSKeyPath != "" {
+			pairs = append(pairs, Certificate{CertPath: u.TLSCertPath, KeyPath: u.TLSKeyPath})
+		}
+	}
+
+	if c.Proxy.TLS.CertDir != "" {
+		entries, err := os.ReadDir(c.Proxy.TLS.CertDir)
+		if err != nil {
+			return nil, fmt.Errorf("error reading certificate directory %s: %w", c.Proxy.TLS.CertDir, err)
+		}
+		for _, e := range entries {
+			ext := filepath.Ext(e.Name())
+			if e.IsDir() || (ext != ".crt" && ext != ".pem") {
+				continue
+			}
+			keyPath := filepath.Join(c.Proxy.TLS.CertDir, strings.TrimSuffix(e.Name(), ext)+".key")
+			if _, err := os.Stat(keyPath); err != nil {
+				continue
+			}
+			pairs = append(pairs, Certificate{
+				CertPath: filepath.Join(c.Proxy.TLS.CertDir, e.Name()),
+				KeyPath:  keyPath,
+			})
+		}
+	}
+
+	return pairs, nil
+}
+
+// add loads a certificate and key pair and indexes it by the names it covers.
+func (s *certSet) add(certPath, keyPath string) (*tls.Certificate, error) {
+	for _, p := range []string{certPath, keyPath} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("error loading certificate %s: %w", certPath, err)
+		}
+		s.modTimes[p] = fi.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading certificate %s: %w", certPath, err)
+	}
+	if cert.Leaf == nil {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing certificate %s: %w", certPath, err)
+		}
+		cert.Leaf = leaf
+	}
+
+	names := cert.Leaf.DNSNames
+	if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+		names = []string{cert.Leaf.Subject.CommonName}
+	}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if _, ok := s.byName[name]; !ok {
+			s.byName[name] = &cert
+		}
+	}
+	s.certs = append(s.certs, &cert)
+	return &cert, nil
+}
+
+// lookup returns the certificate that covers the given server name, or nil if none does.
+func (s *certSet) lookup(serverName string) *tls.Certificate {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if cert, ok := s.byName[name]; ok {
+		return cert
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := s.byName["*"+name[i:]]; ok {
+			return cert
+		}
+	}
+	return nil
+}
+
+// covers returns true if a certificate covers the given host name.
+func (s *certSet) covers(hostName string) bool {
+	return s.lookup(hostWithoutPort(hostName)) != nil
+}
+
+// changed returns true if any file the set was loaded from has been modified.
+func (s *certSet) changed() bool {
+	for p, modTime := range s.modTimes {
+		fi, err := os.Stat(p)
+		if err != nil || !fi.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// covers returns true if a certificate covers the given host name.
+func (s *certStore) covers(hostName string) bool {
+	return s.current.Load().covers(hostName)
+}
+
+// GetCertificate returns the certificate for the server name of the ClientHello.
+// The default certificate is returned if no certificate covers the server name.
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	set := s.current.Load()
+	if cert := set.lookup(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	return set.fallback, nil
+}
+
+// reload loads the certificates again and swaps them in for new handshakes.
+// If the new certificates are invalid, the current ones are kept.
+func (s *certStore) reload() error {
+	set, err := loadCertSet(s.config)
+	if err != nil {
+		return err
+	}
+	s.current.Store(set)
+	s.checkExpiry()
+	return nil
+}
+
+// checkExpiry logs the expiry of each certificate and warns when expiry approaches.
+func (s *certStore) checkExpiry() {
+	days := s.config.Proxy.TLS.ExpiryWarningDays
+	if days <= 0 {
+		days = defaultExpiryWarningDays
+	}
+	for _, cert := range s.current.Load().certs {
+		remaining := time.Until(cert.Leaf.NotAfter)
+		attrs := []any{
+			slog.String("subject", cert.Leaf.Subject.String()),
+			slog.Any("dns_names", cert.Leaf.DNSNames),
+			slog.Time("not_after", cert.Leaf.NotAfter),
+		}
+		switch {
+		case remaining <= 0:
+			slog.Error("certificate has expired", attrs...)
+		case remaining < time.Duration(days)*24*time.Hour:
+			slog.Warn("certificate expires soon", attrs...)
+		default:
+			slog.Info("certificate loaded", attrs...)
+		}
+	}
+}
+
+// watch reloads the certificates when their files change or reload receives, until the context is cancelled.
+func (s *certStore) watch(ctx context.Context, reload <-chan struct{}) {
+	var poll <-chan time.Time
+	if interval := s.config.Proxy.TLS.ReloadInterval; interval >= 0 {
+		d := time.Duration(interval) * time.Millisecond
+		if d == 0 {
+			d = defaultReloadInterval
+		}
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	expiry := time.NewTicker(expiryCheckInterval)
+	defer expiry.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			s.reloadAndLog("reload requested")
+		case <-poll:
+			if s.current.Load().changed() {
+				s.reloadAndLog("certificate files changed")
+			}
+		case <-expiry.C:
+			s.checkExpiry()
+		}
+	}
+}
+
+func (s *certStore) reloadAndLog(reason string) {
+	if err := s.reload(); err != nil {
+		slog.Error("error reloading certificates, keeping current certificates: "+err.Error(), slog.String("reason", reason))
+		return
+	}
+	slog.Info("certificates reloaded", slog.String("reason", reason))
+}
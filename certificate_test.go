@@ -0,0 +1,242 @@
+package gondola
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate for the given DNS names and its key to dir.
+func writeCertificate(t *testing.T, dir, name string, notAfter time.Time, dnsNames ...string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return certPath, keyPath
+}
+
+func TestCertStoreGetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	defaultCert, defaultKey := writeCertificate(t, dir, "default", time.Now().Add(time.Hour), "default.local")
+	exactCert, exactKey := writeCertificate(t, dir, "exact", time.Now().Add(time.Hour), "backend1.local")
+	wildcardCert, wildcardKey := writeCertificate(t, dir, "wildcard", time.Now().Add(time.Hour), "*.example.com")
+
+	c := NewConfig(
+		WithTLS(defaultCert, defaultKey),
+		WithUpstream(Upstream{HostName: "backend1.local", Target: "http://backend1:8081"}),
+		WithUpstream(Upstream{HostName: "api.example.com:443", Target: "http://backend2:8082", TLSCertPath: wildcardCert, TLSKeyPath: wildcardKey}),
+	)
+	c.Proxy.TLS.Certificates = []Certificate{{CertPath: exactCert, KeyPath: exactKey}}
+
+	s, err := newCertStore(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		serverName string
+		expected   string
+	}{
+		{serverName: "backend1.local", expected: "exact"},
+		{serverName: "BACKEND1.local", expected: "exact"},
+		{serverName: "api.example.com", expected: "wildcard"},
+		{serverName: "www.example.com", expected: "wildcard"},
+		{serverName: "a.b.example.com", expected: "default"},
+		{serverName: "example.com", expected: "default"},
+		{serverName: "", expected: "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if cert.Leaf.Subject.CommonName != tt.expected {
+				t.Errorf("Expected certificate %s, got %s", tt.expected, cert.Leaf.Subject.CommonName)
+			}
+		})
+	}
+}
+
+func TestCertStoreCertDir(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificate(t, dir, "backend1", time.Now().Add(time.Hour), "backend1.local")
+	writeCertificate(t, dir, "backend2", time.Now().Add(time.Hour), "backend2.local")
+
+	c := NewConfig(
+		WithUpstream(Upstream{HostName: "backend1.local", Target: "http://backend1:8081"}),
+		WithUpstream(Upstream{HostName: "backend2.local", Target: "http://backend2:8082"}),
+	)
+	c.Proxy.TLS.CertDir = dir
+
+	s, err := newCertStore(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !s.covers("backend1.local") || !s.covers("backend2.local") {
+		t.Error("Expected certificates to cover backend1.local and backend2.local")
+	}
+}
+
+func TestNewCertStoreError(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeCertificate(t, dir, "backend1", time.Now().Add(time.Hour), "backend1.local")
+
+	tests := []struct {
+		name   string
+		config *Config
+	}{
+		{
+			name:   "no certificate",
+			config: NewConfig(),
+		},
+		{
+			name:   "invalid certificate path",
+			config: NewConfig(WithTLS(filepath.Join(dir, "missing.crt"), keyPath)),
+		},
+		{
+			name: "uncovered upstream host",
+			config: NewConfig(
+				WithUpstream(Upstream{HostName: "backend1.local", Target: "http://backend1:8081", TLSCertPath: certPath, TLSKeyPath: keyPath}),
+				WithUpstream(Upstream{HostName: "backend2.local", Target: "http://backend2:8082"}),
+			),
+		},
+		{
+			name: "missing certificate directory",
+			config: &Config{
+				Proxy: Proxy{TLS: TLS{CertDir: filepath.Join(dir, "missing")}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newCertStore(tt.config); err == nil {
+				t.Error("Expected error but got none")
+			}
+		})
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeCertificate(t, dir, "backend1", time.Now().Add(time.Hour), "backend1.local")
+
+	s, err := newCertStore(NewConfig(WithTLS(certPath, keyPath)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	old, _ := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "backend1.local"})
+
+	// An invalid pair keeps the current certificate
+	if err := os.WriteFile(keyPath, []byte("invalid"), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	if err := s.reload(); err == nil {
+		t.Error("Expected error but got none")
+	}
+	if cert, _ := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "backend1.local"}); cert != old {
+		t.Error("Expected current certificate to be kept")
+	}
+
+	// A valid pair replaces the current certificate
+	writeCertificate(t, dir, "backend1", time.Now().Add(2*time.Hour), "backend1.local")
+	if err := s.reload(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cert, _ := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "backend1.local"})
+	if cert == old {
+		t.Error("Expected certificate to be replaced")
+	}
+}
+
+func TestCertStoreWatch(t *testing.T) {
+	tests := []struct {
+		name           string
+		reloadInterval int
+		requestReload  bool
+	}{
+		{name: "file change", reloadInterval: 10},
+		{name: "reload request without watching", reloadInterval: -1, requestReload: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certPath, keyPath := writeCertificate(t, dir, "backend1", time.Now().Add(time.Hour), "backend1.local")
+
+			c := NewConfig(WithTLS(certPath, keyPath))
+			c.Proxy.TLS.ReloadInterval = tt.reloadInterval
+			s, err := newCertStore(c)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			reload := make(chan struct{}, 1)
+			go s.watch(ctx, reload)
+
+			notAfter := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+			writeCertificate(t, dir, "backend1", notAfter, "backend1.local")
+			future := time.Now().Add(time.Minute)
+			for _, p := range []string{certPath, keyPath} {
+				if err := os.Chtimes(p, future, future); err != nil {
+					t.Fatalf("Failed to change times: %v", err)
+				}
+			}
+			if tt.requestReload {
+				reload <- struct{}{}
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for time.Now().Before(deadline) {
+				cert, _ := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "backend1.local"})
+				if cert.Leaf.NotAfter.Equal(notAfter) {
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			t.Fatal("Expected certificate to be reloaded")
+		})
+	}
+}
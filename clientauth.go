@@ -0,0 +1,174 @@
+package gondola
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// clientAuthRequire requires a valid client certificate.
+	clientAuthRequire = "require"
+	// clientAuthVerifyIfGiven verifies a client certificate if one is given.
+	clientAuthVerifyIfGiven = "verify_if_given"
+	// clientAuthNone disables client certificate authentication.
+	clientAuthNone = "none"
+)
+
+const (
+	defaultClientCertSubjectHeader     = "X-Client-Cert-Subject"
+	defaultClientCertSANHeader         = "X-Client-Cert-SAN"
+	defaultClientCertFingerprintHeader = "X-Client-Cert-Fingerprint"
+)
+
+// enabled returns true if client certificates are verified.
+func (ca ClientAuth) enabled() bool {
+	return ca.Mode == clientAuthRequire || ca.Mode == clientAuthVerifyIfGiven
+}
+
+// validate validates the client certificate authentication configuration.
+func (ca ClientAuth) validate() error {
+	switch ca.Mode {
+	case "", clientAuthNone:
+		return nil
+	case clientAuthRequire, clientAuthVerifyIfGiven:
+		if ca.CAFile == "" {
+			return fmt.Errorf("client_auth mode %s requires ca_file", ca.Mode)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid client_auth mode: %s", ca.Mode)
+}
+
+// headerNames returns the header names of the subject, SAN and fingerprint of client certificates.
+func (ca ClientAuth) headerNames() (string, string, string) {
+	subject, san, fingerprint := ca.Headers.Subject, ca.Headers.SAN, ca.Headers.Fingerprint
+	if subject == "" {
+		subject = defaultClientCertSubjectHeader
+	}
+	if san == "" {
+		san = defaultClientCertSANHeader
+	}
+	if fingerprint == "" {
+		fingerprint = defaultClientCertFingerprintHeader
+	}
+	return subject, san, fingerprint
+}
+
+// effectiveClientAuth returns the client certificate authentication of the upstream, or the proxy server's if it is not set.
+func effectiveClientAuth(c *Config, u Upstream) ClientAuth {
+	if u.ClientAuth.Mode != "" {
+		return u.ClientAuth
+	}
+	return c.Proxy.TLS.ClientAuth
+}
+
+// applyClientAuth configures cfg to verify client certificates.
+func applyClientAuth(cfg *tls.Config, ca ClientAuth) error {
+	if !ca.enabled() {
+		cfg.ClientAuth = tls.NoClientCert
+		cfg.ClientCAs = nil
+		return nil
+	}
+
+	pool, err := loadClientCAs(ca)
+	if err != nil {
+		return err
+	}
+
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if ca.Mode == clientAuthRequire {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return nil
+}
+
+// loadClientCAs loads the CA certificates used to verify client certificates.
+func loadClientCAs(ca ClientAuth) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(filepath.Clean(ca.CAFile))
+	if err != nil {
+		return nil, fmt.Errorf("error reading client CA file %s: %w", ca.CAFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in client CA file %s", ca.CAFile)
+	}
+	return pool, nil
+}
+
+// withClientCert returns a handler that forwards verified client certificate details to the upstream in headers.
+// Incoming headers with the same names are removed so that they cannot be spoofed.
+// Client certificates are verified again against the CAs of ca, since the handshake may have been made for another
+// SNI server name than the Host of the request and verified against the CAs of that server name.
+// If a client certificate is required, requests without one are rejected, and requests with a certificate
+// not issued by the CAs of ca are always rejected.
+func withClientCert(next http.Handler, ca ClientAuth) (http.Handler, error) {
+	if !ca.enabled() {
+		return next, nil
+	}
+	pool, err := loadClientCAs(ca)
+	if err != nil {
+		return nil, err
+	}
+	subject, san, fingerprint := ca.headerNames()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(subject)
+		r.Header.Del(san)
+		r.Header.Del(fingerprint)
+
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			if ca.Mode == clientAuthRequire {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		leaf := r.TLS.PeerCertificates[0]
+		intermediates := x509.NewCertPool()
+		for _, cert := range r.TLS.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         pool,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}); err != nil {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		sum := sha256.Sum256(leaf.Raw)
+		r.Header.Set(subject, leaf.Subject.String())
+		r.Header.Set(san, certificateSANs(leaf))
+		r.Header.Set(fingerprint, hex.EncodeToString(sum[:]))
+		next.ServeHTTP(w, r)
+	}), nil
+}
+
+// certificateSANs returns the subject alternative names of the certificate as a comma separated list.
+func certificateSANs(cert *x509.Certificate) string {
+	var sans []string
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS:"+name)
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, "URI:"+uri.String())
+	}
+	return strings.Join(sans, ",")
+}
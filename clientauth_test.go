@@ -0,0 +1,193 @@
+package gondola
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientAuthValidate(t *testing.T) {
+	tests := []struct {
+		name          string
+		clientAuth    ClientAuth
+		expectedError bool
+	}{
+		{name: "disabled", clientAuth: ClientAuth{}},
+		{name: "none", clientAuth: ClientAuth{Mode: clientAuthNone}},
+		{name: "require", clientAuth: ClientAuth{Mode: clientAuthRequire, CAFile: "ca.pem"}},
+		{name: "verify if given", clientAuth: ClientAuth{Mode: clientAuthVerifyIfGiven, CAFile: "ca.pem"}},
+		{name: "require without CA file", clientAuth: ClientAuth{Mode: clientAuthRequire}, expectedError: true},
+		{name: "invalid mode", clientAuth: ClientAuth{Mode: "optional"}, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.clientAuth.validate()
+			if tt.expectedError && err == nil {
+				t.Error("Expected error but got none")
+			}
+			if !tt.expectedError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey := writeCertificate(t, dir, "server", time.Now().Add(time.Hour), "secure.local", "public.local", "partner.local")
+	clientCert, clientKey := writeCertificate(t, dir, "client", time.Now().Add(time.Hour), "client.local")
+	// partner.local trusts its own CA, which secure.local does not trust.
+	partnerCert, partnerKey := writeCertificate(t, dir, "partner", time.Now().Add(time.Hour), "partner.local")
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Subject") + "|" + r.Header.Get("X-Client-Cert-SAN")))
+	}))
+	defer backend.Close()
+
+	c := NewConfig(
+		WithTLS(serverCert, serverKey),
+		WithListener(Listener{Address: "127.0.0.1:18445", TLS: true}),
+		WithUpstream(Upstream{
+			HostName: "secure.local",
+			Target:   backend.URL,
+			ClientAuth: ClientAuth{
+				Mode:    clientAuthRequire,
+				CAFile:  clientCert,
+				Headers: ClientCertHeaders{Subject: "X-Subject"},
+			},
+		}),
+		WithUpstream(Upstream{HostName: "public.local", Target: backend.URL}),
+		WithUpstream(Upstream{
+			HostName:   "partner.local",
+			Target:     backend.URL,
+			ClientAuth: ClientAuth{Mode: clientAuthRequire, CAFile: partnerCert},
+		}),
+	)
+
+	gondola, err := NewGondolaFromConfig(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- gondola.Run(ctx)
+	}()
+	waitForServer(t, "127.0.0.1:18445")
+
+	certs := make(map[string]tls.Certificate)
+	for name, pair := range map[string][2]string{"client": {clientCert, clientKey}, "partner": {partnerCert, partnerKey}} {
+		cert, err := tls.LoadX509KeyPair(pair[0], pair[1])
+		if err != nil {
+			t.Fatalf("Failed to load client certificate: %v", err)
+		}
+		certs[name] = cert
+	}
+
+	for _, test := range []struct {
+		name          string
+		serverName    string
+		host          string
+		clientCert    string
+		header        string
+		code          int
+		body          string
+		expectedError bool
+	}{
+		{
+			name:       "client certificate given",
+			serverName: "secure.local",
+			host:       "secure.local",
+			clientCert: "client",
+			header:     "spoofed",
+			code:       http.StatusOK,
+			body:       "CN=client|DNS:client.local",
+		},
+		{
+			name:       "client certificate of another host",
+			serverName: "partner.local",
+			host:       "partner.local",
+			clientCert: "partner",
+			code:       http.StatusOK,
+			body:       "|DNS:partner.local",
+		},
+		{
+			name:       "client certificate verified for another server name",
+			serverName: "partner.local",
+			host:       "secure.local",
+			clientCert: "partner",
+			header:     "spoofed",
+			code:       http.StatusForbidden,
+		},
+		{
+			name:          "client certificate not given",
+			serverName:    "secure.local",
+			host:          "secure.local",
+			expectedError: true,
+		},
+		{
+			name:       "client authentication not configured",
+			serverName: "public.local",
+			host:       "public.local",
+			code:       http.StatusOK,
+			body:       "|",
+		},
+		{
+			name:       "host differs from server name",
+			serverName: "public.local",
+			host:       "secure.local",
+			header:     "spoofed",
+			code:       http.StatusForbidden,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tlsConfig := &tls.Config{InsecureSkipVerify: true, ServerName: test.serverName}
+			if test.clientCert != "" {
+				tlsConfig.Certificates = []tls.Certificate{certs[test.clientCert]}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+
+			req, err := http.NewRequest(http.MethodGet, "https://127.0.0.1:18445/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = test.host
+			if test.header != "" {
+				req.Header.Set("X-Subject", test.header)
+			}
+			res, err := client.Do(req)
+			if test.expectedError {
+				if err == nil {
+					res.Body.Close()
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != test.code {
+				t.Errorf("Expected status code %d, got %d", test.code, res.StatusCode)
+			}
+			if test.body != "" && string(b) != test.body {
+				t.Errorf("Expected body %s, got %s", test.body, string(b))
+			}
+		})
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
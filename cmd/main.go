@@ -1,21 +1,27 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime/debug"
+	"syscall"
 
 	"github.com/bmf-san/gondola"
 )
 
-var cfgFile string
+var (
+	cfgFile   string
+	cfgFormat string
+)
 
 func init() {
 	flag.StringVar(&cfgFile, "config", "config.yaml", "config file path")
-
+	flag.StringVar(&cfgFormat, "format", "", "config file format (yaml, json or toml). inferred from the file extension if empty")
 }
 
 // parseFlags parses the command line flags.
@@ -43,6 +49,14 @@ func setConfig(cfgFile string) (*os.File, error) {
 	return cfg, nil
 }
 
+// setFormat returns the config file format.
+func setFormat(cfgFile, cfgFormat string) (gondola.Format, error) {
+	if cfgFormat != "" {
+		return gondola.ParseFormat(cfgFormat)
+	}
+	return gondola.FormatFromPath(cfgFile)
+}
+
 func main() {
 	defer func() {
 		if x := recover(); x != nil {
@@ -63,13 +77,36 @@ func main() {
 		os.Exit(1)
 	}
 
-	gondola, err := gondola.NewGondola(cfg)
+	format, err := setFormat(cfgFile, cfgFormat)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	gondola, err := gondola.NewGondolaWithFormat(cfg, format)
 	if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
 	}
 
-	err = gondola.Run()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				gondola.ReloadCertificates()
+			}
+		}
+	}()
+
+	err = gondola.Run(ctx)
 	if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
@@ -4,6 +4,8 @@ import (
 	"flag"
 	"os"
 	"testing"
+
+	"github.com/bmf-san/gondola"
 )
 
 func TestParseFlags(t *testing.T) {
@@ -42,3 +44,39 @@ func TestSetConfig(t *testing.T) {
 		t.Errorf("unexpected error: %v", err)
 	}
 }
+
+func TestSetFormat(t *testing.T) {
+	cases := []struct {
+		name      string
+		cfgFile   string
+		cfgFormat string
+		expected  gondola.Format
+		wantErr   bool
+	}{
+		{name: "yaml extension", cfgFile: "config.yaml", expected: gondola.FormatYAML},
+		{name: "yml extension", cfgFile: "config.yml", expected: gondola.FormatYAML},
+		{name: "json extension", cfgFile: "config.json", expected: gondola.FormatJSON},
+		{name: "toml extension", cfgFile: "config.toml", expected: gondola.FormatTOML},
+		{name: "explicit format", cfgFile: "config", cfgFormat: "json", expected: gondola.FormatJSON},
+		{name: "unknown extension", cfgFile: "config.ini", wantErr: true},
+		{name: "unknown format", cfgFile: "config.yaml", cfgFormat: "ini", wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actual, err := setFormat(c.cfgFile, c.cfgFormat)
+			if c.wantErr {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if actual != c.expected {
+				t.Errorf("expected %v, got %v", c.expected, actual)
+			}
+		})
+	}
+}
@@ -1,60 +1,452 @@
 package gondola
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/pelletier/go-toml/v2"
 	"gopkg.in/yaml.v3"
 )
 
 // Proxy is a struct that represents the proxy server.
 // Port is the port that the proxy server will listen on.
 // ShutdownTimeout is the timeout in milliseconds for the proxy server to shutdown.
+// RetryBudget limits the retries of all upstreams.
+// Docker adds upstreams for running containers.
 type Proxy struct {
-	Port              string       `yaml:"port"`
-	ReadHeaderTimeout int          `yaml:"read_header_timeout"`
-	ShutdownTimeout   int          `yaml:"shutdown_timeout"`
-	TLSCertPath       string       `yaml:"tls_cert_path"`
-	TLSKeyPath        string       `yaml:"tls_key_path"`
-	StaticFiles       []StaticFile `yaml:"static_files"`
+	Port              string       `yaml:"port" json:"port" toml:"port"`
+	ReadHeaderTimeout int          `yaml:"read_header_timeout" json:"read_header_timeout" toml:"read_header_timeout"`
+	ShutdownTimeout   int          `yaml:"shutdown_timeout" json:"shutdown_timeout" toml:"shutdown_timeout"`
+	TLSCertPath       string       `yaml:"tls_cert_path" json:"tls_cert_path" toml:"tls_cert_path"`
+	TLSKeyPath        string       `yaml:"tls_key_path" json:"tls_key_path" toml:"tls_key_path"`
+	StaticFiles       []StaticFile `yaml:"static_files" json:"static_files" toml:"static_files"`
+	Listeners         []Listener   `yaml:"listeners" json:"listeners" toml:"listeners"`
+	TLS               TLS          `yaml:"tls" json:"tls" toml:"tls"`
+	ACME              ACME         `yaml:"acme" json:"acme" toml:"acme"`
+	RetryBudget       RetryBudget  `yaml:"retry_budget" json:"retry_budget" toml:"retry_budget"`
+	Docker            Docker       `yaml:"docker" json:"docker" toml:"docker"`
+}
+
+// Docker is a struct that represents the discovery of upstreams from the labels of running containers.
+// Containers labeled gondola.host with the host name and gondola.port with the port they listen on are added as targets of the upstream with the host name.
+// Upstreams in the configuration file take precedence over containers with the same host name.
+// Endpoint is the Docker Engine API, such as "unix:///var/run/docker.sock" (default) or "tcp://127.0.0.1:2375".
+// Network is the network of the containers to connect to, or empty to use the first of their networks by name.
+// Interval is the interval in milliseconds to list the containers (default 5000). Docker events are not followed,
+// so started and stopped containers are applied up to Interval later.
+type Docker struct {
+	Enabled  bool   `yaml:"enabled" json:"enabled" toml:"enabled"`
+	Endpoint string `yaml:"endpoint" json:"endpoint" toml:"endpoint"`
+	Network  string `yaml:"network" json:"network" toml:"network"`
+	Interval int    `yaml:"interval" json:"interval" toml:"interval"`
+}
+
+// RetryBudget is a struct that represents the limit of retries across all upstreams to avoid retry storms.
+// Retries within a second are limited to Percent of the requests (default 20) plus MinRetries (default 10).
+type RetryBudget struct {
+	Percent    int `yaml:"percent" json:"percent" toml:"percent"`
+	MinRetries int `yaml:"min_retries" json:"min_retries" toml:"min_retries"`
+}
+
+// ACME is a struct that represents the configuration to obtain certificates for upstream host names automatically.
+// DirectoryURL is the ACME directory URL (default Let's Encrypt).
+// CAFile is a CA bundle to trust the ACME server, e.g. a local Pebble test CA.
+// CacheDir is the directory where certificates and the account key are cached (default gondola/acme in the user configuration directory, created with 0700).
+// RenewBeforeDays is the number of days before expiry to renew certificates (default 30).
+// Challenges are the enabled challenge types, http-01 and tls-alpn-01 (default both).
+// The static certificates are used when issuance fails.
+type ACME struct {
+	Enabled         bool     `yaml:"enabled" json:"enabled" toml:"enabled"`
+	Email           string   `yaml:"email" json:"email" toml:"email"`
+	DirectoryURL    string   `yaml:"directory_url" json:"directory_url" toml:"directory_url"`
+	CAFile          string   `yaml:"ca_file" json:"ca_file" toml:"ca_file"`
+	CacheDir        string   `yaml:"cache_dir" json:"cache_dir" toml:"cache_dir"`
+	RenewBeforeDays int      `yaml:"renew_before_days" json:"renew_before_days" toml:"renew_before_days"`
+	Challenges      []string `yaml:"challenges" json:"challenges" toml:"challenges"`
+}
+
+// TLS is a struct that represents the TLS configuration of the proxy server.
+// Certificates are selected by SNI. TLSCertPath and TLSKeyPath of Proxy are used as the default certificate.
+// CertDir is a directory containing <name>.crt or <name>.pem certificates with <name>.key keys.
+// ReloadInterval is the interval in milliseconds to check certificate files for changes (default 10000). A negative value disables watching.
+// ExpiryWarningDays is the number of days before expiry from which a warning is logged (default 30).
+// MinVersion and MaxVersion are TLS versions such as "1.2" or "1.3".
+// CipherSuites are TLS 1.0-1.2 cipher suite names such as "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256".
+// CurvePreferences are curve names such as "X25519" or "P-256".
+// SessionTicketKeyRotation is the interval in milliseconds to rotate session ticket keys. 0 uses the Go default.
+// ALPN is the list of protocols advertised via ALPN (default h2 and http/1.1).
+type TLS struct {
+	Certificates             []Certificate `yaml:"certificates" json:"certificates" toml:"certificates"`
+	CertDir                  string        `yaml:"cert_dir" json:"cert_dir" toml:"cert_dir"`
+	ReloadInterval           int           `yaml:"reload_interval" json:"reload_interval" toml:"reload_interval"`
+	ExpiryWarningDays        int           `yaml:"expiry_warning_days" json:"expiry_warning_days" toml:"expiry_warning_days"`
+	MinVersion               string        `yaml:"min_version" json:"min_version" toml:"min_version"`
+	MaxVersion               string        `yaml:"max_version" json:"max_version" toml:"max_version"`
+	CipherSuites             []string      `yaml:"cipher_suites" json:"cipher_suites" toml:"cipher_suites"`
+	CurvePreferences         []string      `yaml:"curve_preferences" json:"curve_preferences" toml:"curve_preferences"`
+	SessionTicketKeyRotation int           `yaml:"session_ticket_key_rotation" json:"session_ticket_key_rotation" toml:"session_ticket_key_rotation"`
+	ALPN                     []string      `yaml:"alpn" json:"alpn" toml:"alpn"`
+	HSTS                     HSTS          `yaml:"hsts" json:"hsts" toml:"hsts"`
+	ClientAuth               ClientAuth    `yaml:"client_auth" json:"client_auth" toml:"client_auth"`
+}
+
+// ClientAuth is a struct that represents client certificate authentication on TLS listeners.
+// Mode is "require", "verify_if_given" or "none". Client authentication is disabled if Mode is empty.
+// CAFile is a CA bundle to verify client certificates.
+// Headers are the request headers used to forward verified client certificate details to the upstream.
+type ClientAuth struct {
+	Mode    string            `yaml:"mode" json:"mode" toml:"mode"`
+	CAFile  string            `yaml:"ca_file" json:"ca_file" toml:"ca_file"`
+	Headers ClientCertHeaders `yaml:"headers" json:"headers" toml:"headers"`
+}
+
+// ClientCertHeaders is a struct that represents the header names of client certificate details.
+// Subject defaults to X-Client-Cert-Subject, SAN to X-Client-Cert-SAN and Fingerprint (SHA-256) to X-Client-Cert-Fingerprint.
+type ClientCertHeaders struct {
+	Subject     string `yaml:"subject" json:"subject" toml:"subject"`
+	SAN         string `yaml:"san" json:"san" toml:"san"`
+	Fingerprint string `yaml:"fingerprint" json:"fingerprint" toml:"fingerprint"`
+}
+
+// HSTS is a struct that represents the Strict-Transport-Security header added to responses on TLS listeners.
+// The header is added when MaxAge is greater than 0. MaxAge is in seconds.
+type HSTS struct {
+	MaxAge            int  `yaml:"max_age" json:"max_age" toml:"max_age"`
+	IncludeSubDomains bool `yaml:"include_subdomains" json:"include_subdomains" toml:"include_subdomains"`
+	Preload           bool `yaml:"preload" json:"preload" toml:"preload"`
+}
+
+// Certificate is a struct that represents a certificate and key pair.
+type Certificate struct {
+	CertPath string `yaml:"cert_path" json:"cert_path" toml:"cert_path"`
+	KeyPath  string `yaml:"key_path" json:"key_path" toml:"key_path"`
+}
+
+// Listener is a struct that represents an address that the proxy server will listen on.
+// Address is the bind address such as ":80", "0.0.0.0:80", "[::]:443" or "192.168.0.1:8080".
+// RedirectToHTTPS redirects requests on a plain listener to the first TLS listener, except ACME challenge paths.
+// RedirectStatus is the status code used for the redirect, 301 or 308 (default 308).
+// H2C serves HTTP/2 over cleartext in addition to HTTP/1.1 on a plain listener.
+// HTTP3 serves HTTP/3 over QUIC on the same UDP port of a TLS listener and advertises it via Alt-Svc.
+// Address can also be a unix domain socket such as "unix:///run/gondola.sock", whose permission is set by SocketMode such as "0660".
+type Listener struct {
+	Address         string `yaml:"address" json:"address" toml:"address"`
+	TLS             bool   `yaml:"tls" json:"tls" toml:"tls"`
+	RedirectToHTTPS bool   `yaml:"redirect_to_https" json:"redirect_to_https" toml:"redirect_to_https"`
+	RedirectStatus  int    `yaml:"redirect_status" json:"redirect_status" toml:"redirect_status"`
+	H2C             bool   `yaml:"h2c" json:"h2c" toml:"h2c"`
+	HTTP3           bool   `yaml:"http3" json:"http3" toml:"http3"`
+	SocketMode      string `yaml:"socket_mode" json:"socket_mode" toml:"socket_mode"`
 }
 
 // StaticFile is a struct that represents a static file configuration.
 type StaticFile struct {
-	Path         string `yaml:"path"`
-	Dir          string `yaml:"dir"`
-	FallbackPath string `yaml:"fallback_path"` // Path to fallback file when requested file is not found
+	Path         string `yaml:"path" json:"path" toml:"path"`
+	Dir          string `yaml:"dir" json:"dir" toml:"dir"`
+	FallbackPath string `yaml:"fallback_path" json:"fallback_path" toml:"fallback_path"` // Path to fallback file when requested file is not found
 }
 
 // IsEnableTLS returns true if the proxy server is configured to use TLS.
 func (p *Proxy) IsEnableTLS() bool {
-	return p.TLSCertPath != "" && p.TLSKeyPath != ""
+	return p.hasCertificates() || p.ACME.Enabled
+}
+
+// hasCertificates returns true if static certificates are configured for the proxy server.
+func (p *Proxy) hasCertificates() bool {
+	return (p.TLSCertPath != "" && p.TLSKeyPath != "") || len(p.TLS.Certificates) > 0 || p.TLS.CertDir != ""
+}
+
+// GetListeners returns the listeners of the proxy server.
+// If no listeners are configured, a single listener on Port is returned, using TLS if IsEnableTLS is true.
+func (p *Proxy) GetListeners() []Listener {
+	if len(p.Listeners) > 0 {
+		return p.Listeners
+	}
+	return []Listener{
+		{
+			Address: ":" + p.Port,
+			TLS:     p.IsEnableTLS(),
+		},
+	}
 }
 
 // Upstream is a struct that represents a backend server.
 // HostName is the hostname that the proxy will listen for.
-// Target is the target URL that the proxy will forward requests to.
+// Target is the target URL that the proxy will forward requests to, or a unix domain socket such as "unix:///run/app.sock".
+// Targets are additional targets, requests are balanced across Target and Targets in round robin order.
+// TLSCertPath and TLSKeyPath are the certificate served for HostName when TLS is enabled.
+// ClientAuth overrides the client certificate authentication of the proxy server for HostName.
+// TargetTLS is the TLS configuration used to connect to an https Target.
+// Protocol is the protocol used to connect to Target, "http1", "h2" (https only) or "h2c" (http only).
+// If Protocol is empty, HTTP/1.1 is used for http targets and HTTP/2 is negotiated for https targets.
+// WebSocket limits WebSocket connections proxied to Target.
+// FlushInterval is how often responses are flushed to the client, "immediate" or a duration such as "100ms".
+// Server-Sent Events and responses of unknown length are always flushed immediately.
+// FastCGI is the configuration of a FastCGI Target such as "tcp://127.0.0.1:9000" or "unix:///run/php-fpm.sock",
+// used when Protocol is "fastcgi".
+// OutlierDetection ejects targets that keep failing from the balancing of live traffic.
+// Retry retries failed attempts, on another target if the upstream has several.
+// CircuitBreaker stops sending requests to failing targets for a while.
+// ConcurrencyLimit limits the in-flight requests to the upstream.
+// Affinity sends the requests of a client to the same target.
+// SlowStart is the duration in milliseconds over which the share of traffic of a target that joined or recovered
+// ramps up linearly from a tenth to its full share. 0 disables slow start.
+// DNS discovers the targets from DNS records instead of Target and Targets.
+// FileDiscovery discovers the targets from a file instead of Target and Targets.
 type Upstream struct {
-	HostName string `yaml:"host_name"`
-	Target   string `yaml:"target"`
+	HostName      string     `yaml:"host_name" json:"host_name" toml:"host_name"`
+	Target        string     `yaml:"target" json:"target" toml:"target"`
+	Targets       []string   `yaml:"targets" json:"targets" toml:"targets"`
+	TLSCertPath   string     `yaml:"tls_cert_path" json:"tls_cert_path" toml:"tls_cert_path"`
+	TLSKeyPath    string     `yaml:"tls_key_path" json:"tls_key_path" toml:"tls_key_path"`
+	ClientAuth    ClientAuth `yaml:"client_auth" json:"client_auth" toml:"client_auth"`
+	TargetTLS     TargetTLS  `yaml:"target_tls" json:"target_tls" toml:"target_tls"`
+	Protocol      string     `yaml:"protocol" json:"protocol" toml:"protocol"`
+	WebSocket     WebSocket  `yaml:"websocket" json:"websocket" toml:"websocket"`
+	FlushInterval string     `yaml:"flush_interval" json:"flush_interval" toml:"flush_interval"`
+	FastCGI       FastCGI    `yaml:"fastcgi" json:"fastcgi" toml:"fastcgi"`
+
+	OutlierDetection OutlierDetection `yaml:"outlier_detection" json:"outlier_detection" toml:"outlier_detection"`
+	Retry            Retry            `yaml:"retry" json:"retry" toml:"retry"`
+	CircuitBreaker   CircuitBreaker   `yaml:"circuit_breaker" json:"circuit_breaker" toml:"circuit_breaker"`
+	ConcurrencyLimit ConcurrencyLimit `yaml:"concurrency_limit" json:"concurrency_limit" toml:"concurrency_limit"`
+	Affinity         Affinity         `yaml:"affinity" json:"affinity" toml:"affinity"`
+	SlowStart        int              `yaml:"slow_start" json:"slow_start" toml:"slow_start"`
+	DNS              DNSDiscovery     `yaml:"dns" json:"dns" toml:"dns"`
+	FileDiscovery    FileDiscovery    `yaml:"file_discovery" json:"file_discovery" toml:"file_discovery"`
+}
+
+// FileDiscovery is a struct that represents the discovery of upstream targets from a file, which is read again every Interval.
+// Path is a JSON or YAML file, inferred from its extension, that lists groups of host_name and targets.
+// The targets of the groups whose host_name is the host name of the upstream, or empty, are used.
+// Interval is in milliseconds (default 5000).
+type FileDiscovery struct {
+	Path     string `yaml:"path" json:"path" toml:"path"`
+	Interval int    `yaml:"interval" json:"interval" toml:"interval"`
+}
+
+// DNSDiscovery is a struct that represents the discovery of upstream targets from DNS records, which are looked up again every Interval.
+// Name is looked up for A and AAAA records if Type is "a" (default), whose addresses become targets with Port.
+// If Type is "srv", Name is a SRV record such as "_http._tcp.backend.internal", whose records of the lowest priority become targets.
+// Scheme is the scheme of the targets, "http" (default) or "https".
+// Resolver is the address of the DNS server such as "10.0.0.2:53", or empty to use the system resolver.
+// Interval is in milliseconds (default 30000). The TTL of the records is not used, so Interval should not exceed it.
+type DNSDiscovery struct {
+	Name     string `yaml:"name" json:"name" toml:"name"`
+	Type     string `yaml:"type" json:"type" toml:"type"`
+	Port     int    `yaml:"port" json:"port" toml:"port"`
+	Scheme   string `yaml:"scheme" json:"scheme" toml:"scheme"`
+	Resolver string `yaml:"resolver" json:"resolver" toml:"resolver"`
+	Interval int    `yaml:"interval" json:"interval" toml:"interval"`
+}
+
+// Affinity is a struct that represents the session affinity of an upstream with multiple targets.
+// Type is "cookie" or "hash". Affinity is disabled if Type is empty.
+// With "cookie", gondola sets a cookie named CookieName (default gondola_affinity) naming the target, signed with CookieSecret.
+// A random secret is used if CookieSecret is empty, which invalidates the cookies on restart. CookieMaxAge is in seconds, 0 for session cookies.
+// With "hash", HashOn is "client_ip", "header" or "cookie", and HashKey is the name of the header or cookie.
+// Requests are mapped to targets by consistent hashing, so only the requests of an unhealthy target are moved to other targets.
+type Affinity struct {
+	Type         string `yaml:"type" json:"type" toml:"type"`
+	CookieName   string `yaml:"cookie_name" json:"cookie_name" toml:"cookie_name"`
+	CookieSecret string `yaml:"cookie_secret" json:"cookie_secret" toml:"cookie_secret"`
+	CookieMaxAge int    `yaml:"cookie_max_age" json:"cookie_max_age" toml:"cookie_max_age"`
+	HashOn       string `yaml:"hash_on" json:"hash_on" toml:"hash_on"`
+	HashKey      string `yaml:"hash_key" json:"hash_key" toml:"hash_key"`
+}
+
+// ConcurrencyLimit is a struct that represents the limit of in-flight requests to an upstream across its targets.
+// MaxRequests is the maximum number of in-flight requests. 0 disables the limit.
+// Requests beyond the limit wait in a FIFO queue of QueueSize for up to QueueTimeout (default 1000), or get 503.
+// Adaptive adjusts the limit between MinRequests (default 1) and MaxRequests from the observed upstream response time.
+// QueueTimeout is in milliseconds. There is no limit per target.
+type ConcurrencyLimit struct {
+	MaxRequests  int  `yaml:"max_requests" json:"max_requests" toml:"max_requests"`
+	QueueSize    int  `yaml:"queue_size" json:"queue_size" toml:"queue_size"`
+	QueueTimeout int  `yaml:"queue_timeout" json:"queue_timeout" toml:"queue_timeout"`
+	Adaptive     bool `yaml:"adaptive" json:"adaptive" toml:"adaptive"`
+	MinRequests  int  `yaml:"min_requests" json:"min_requests" toml:"min_requests"`
+}
+
+// CircuitBreaker is a struct that represents the circuit breaker of each upstream target.
+// The circuit of a target opens when at least MinRequests (default 20) are made within Window (default 10000)
+// and ErrorRate percent of them are connection errors, 5xx responses or slower than LatencyThreshold.
+// While the circuit is open, requests go to other targets, or get 503 with Retry-After if all circuits are open.
+// After OpenDuration (default 30000), HalfOpenRequests (default 1) probe requests decide whether to close the circuit again.
+// An ErrorRate of 0 disables the circuit breaker. LatencyThreshold, Window and OpenDuration are in milliseconds.
+type CircuitBreaker struct {
+	ErrorRate        int `yaml:"error_rate" json:"error_rate" toml:"error_rate"`
+	LatencyThreshold int `yaml:"latency_threshold" json:"latency_threshold" toml:"latency_threshold"`
+	MinRequests      int `yaml:"min_requests" json:"min_requests" toml:"min_requests"`
+	Window           int `yaml:"window" json:"window" toml:"window"`
+	OpenDuration     int `yaml:"open_duration" json:"open_duration" toml:"open_duration"`
+	HalfOpenRequests int `yaml:"half_open_requests" json:"half_open_requests" toml:"half_open_requests"`
+}
+
+// Retry is a struct that represents the retry policy of requests to upstream targets.
+// MaxAttempts is the maximum number of attempts including the first one. 0 or 1 disables retries.
+// On are the errors that are retried, "connect_error" and "timeout" (default connect_error).
+// StatusCodes are the response status codes that are retried such as 502 or 503.
+// Methods are the request methods that are retried (default GET, HEAD, OPTIONS, PUT, DELETE and TRACE).
+// Backoff is the delay before the first retry, which doubles with each retry up to MaxBackoff, with random jitter.
+// Backoff and MaxBackoff are in milliseconds (default 25 and 250).
+// MaxBodySize is the maximum request body in bytes buffered to be replayed, larger requests are not retried (default 65536).
+// PerTryTimeout is the time in milliseconds an attempt waits for response headers before it fails as a "timeout".
+// 0 disables it, in which case only TLS handshake timeouts count as "timeout".
+type Retry struct {
+	MaxAttempts   int      `yaml:"max_attempts" json:"max_attempts" toml:"max_attempts"`
+	On            []string `yaml:"on" json:"on" toml:"on"`
+	StatusCodes   []int    `yaml:"status_codes" json:"status_codes" toml:"status_codes"`
+	Methods       []string `yaml:"methods" json:"methods" toml:"methods"`
+	Backoff       int      `yaml:"backoff" json:"backoff" toml:"backoff"`
+	MaxBackoff    int      `yaml:"max_backoff" json:"max_backoff" toml:"max_backoff"`
+	MaxBodySize   int64    `yaml:"max_body_size" json:"max_body_size" toml:"max_body_size"`
+	PerTryTimeout int      `yaml:"per_try_timeout" json:"per_try_timeout" toml:"per_try_timeout"`
+}
+
+// OutlierDetection is a struct that represents the passive health checking of upstream targets.
+// A target is ejected after ConsecutiveErrors connection errors or 5xx responses in a row within Interval.
+// It is re-admitted after BaseEjectionTime, which doubles with each ejection up to MaxEjectionTime.
+// MaxEjectionPercent is the maximum percentage of targets ejected at once, and at least one target is always kept.
+// A ConsecutiveErrors of 0 disables outlier detection. Interval, BaseEjectionTime and MaxEjectionTime are in milliseconds.
+type OutlierDetection struct {
+	ConsecutiveErrors  int `yaml:"consecutive_errors" json:"consecutive_errors" toml:"consecutive_errors"`
+	Interval           int `yaml:"interval" json:"interval" toml:"interval"`
+	BaseEjectionTime   int `yaml:"base_ejection_time" json:"base_ejection_time" toml:"base_ejection_time"`
+	MaxEjectionTime    int `yaml:"max_ejection_time" json:"max_ejection_time" toml:"max_ejection_time"`
+	MaxEjectionPercent int `yaml:"max_ejection_percent" json:"max_ejection_percent" toml:"max_ejection_percent"`
+}
+
+// FastCGI is a struct that represents the parameters sent to a FastCGI server such as PHP-FPM.
+// Root is the document root on the FastCGI server, used for DOCUMENT_ROOT and SCRIPT_FILENAME.
+// SplitPath is the extension that splits the request path into SCRIPT_NAME and PATH_INFO (default ".php").
+// Index is the script served for paths ending with "/" or without SplitPath (default "index.php").
+// Params are additional parameters sent with every request.
+type FastCGI struct {
+	Root      string            `yaml:"root" json:"root" toml:"root"`
+	SplitPath string            `yaml:"split_path" json:"split_path" toml:"split_path"`
+	Index     string            `yaml:"index" json:"index" toml:"index"`
+	Params    map[string]string `yaml:"params" json:"params" toml:"params"`
+}
+
+// WebSocket is a struct that represents the limits of WebSocket connections.
+// IdleTimeout closes a connection without traffic in either direction for this long. IdleTimeout is in milliseconds.
+// MaxDuration closes a connection after it has been open for this long. MaxDuration is in milliseconds.
+// MaxConnections is the maximum number of concurrent connections, beyond which upgrades are rejected with 503.
+// A value of 0 means no limit.
+type WebSocket struct {
+	IdleTimeout    int `yaml:"idle_timeout" json:"idle_timeout" toml:"idle_timeout"`
+	MaxDuration    int `yaml:"max_duration" json:"max_duration" toml:"max_duration"`
+	MaxConnections int `yaml:"max_connections" json:"max_connections" toml:"max_connections"`
+}
+
+// TargetTLS is a struct that represents the TLS configuration toward an upstream target.
+// CAFile is a CA bundle to verify the target's certificate instead of the system roots.
+// CertPath and KeyPath are the client certificate presented to the target.
+// ServerName overrides the SNI name and the name verified in the target's certificate.
+// InsecureSkipVerify disables verification of the target's certificate and must only be used for development.
+type TargetTLS struct {
+	CAFile             string `yaml:"ca_file" json:"ca_file" toml:"ca_file"`
+	CertPath           string `yaml:"cert_path" json:"cert_path" toml:"cert_path"`
+	KeyPath            string `yaml:"key_path" json:"key_path" toml:"key_path"`
+	ServerName         string `yaml:"server_name" json:"server_name" toml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" json:"insecure_skip_verify" toml:"insecure_skip_verify"`
+}
+
+// Stream is a struct that represents a layer 4 proxy that forwards raw TCP connections or UDP datagrams.
+// Listen is the bind address such as ":5432". Protocol is "tcp" (default) or "udp".
+// Targets are the addresses that connections are forwarded to in round robin order.
+// TLS terminates TLS with the certificates of the proxy server before forwarding (tcp only).
+// Routes forward connections to other targets by SNI server name (tcp only).
+// Without TLS, the server name is read from the ClientHello and the TLS connection is passed through.
+// IdleTimeout closes connections without traffic in either direction for this long. IdleTimeout is in milliseconds.
+// For udp, IdleTimeout expires client sessions and defaults to 60000.
+// MaxSessions is the maximum number of udp client sessions (default 10000). Datagrams of new clients are dropped beyond it.
+type Stream struct {
+	Listen      string        `yaml:"listen" json:"listen" toml:"listen"`
+	Protocol    string        `yaml:"protocol" json:"protocol" toml:"protocol"`
+	Targets     []string      `yaml:"targets" json:"targets" toml:"targets"`
+	TLS         bool          `yaml:"tls" json:"tls" toml:"tls"`
+	Routes      []StreamRoute `yaml:"routes" json:"routes" toml:"routes"`
+	IdleTimeout int           `yaml:"idle_timeout" json:"idle_timeout" toml:"idle_timeout"`
+	MaxSessions int           `yaml:"max_sessions" json:"max_sessions" toml:"max_sessions"`
+}
+
+// StreamRoute is a struct that represents the targets of a stream for an SNI server name.
+type StreamRoute struct {
+	ServerName string   `yaml:"server_name" json:"server_name" toml:"server_name"`
+	Targets    []string `yaml:"targets" json:"targets" toml:"targets"`
 }
 
 // Config is a struct that represents the configuration of the proxy.
 type Config struct {
-	Proxy     Proxy      `yaml:"proxy"`
-	Upstreams []Upstream `yaml:"upstreams"`
-	LogLevel  int        `yaml:"log_level"` // Debug:-4 Info:0 Warn:4 Error:8
+	Proxy     Proxy      `yaml:"proxy" json:"proxy" toml:"proxy"`
+	Upstreams []Upstream `yaml:"upstreams" json:"upstreams" toml:"upstreams"`
+	LogLevel  int        `yaml:"log_level" json:"log_level" toml:"log_level"` // Debug:-4 Info:0 Warn:4 Error:8
+	Streams   []Stream   `yaml:"streams" json:"streams" toml:"streams"`
 }
 
-// Load reads the configuration from a reader and returns a Config struct.
+// Format is the format of a configuration file.
+type Format string
+
+const (
+	// FormatYAML is the YAML configuration format.
+	FormatYAML Format = "yaml"
+	// FormatJSON is the JSON configuration format.
+	FormatJSON Format = "json"
+	// FormatTOML is the TOML configuration format.
+	FormatTOML Format = "toml"
+)
+
+// ParseFormat returns the Format for the given name.
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "yaml", "yml":
+		return FormatYAML, nil
+	case "json":
+		return FormatJSON, nil
+	case "toml":
+		return FormatTOML, nil
+	}
+	return "", fmt.Errorf("unsupported config format: %q", name)
+}
+
+// FormatFromPath returns the Format inferred from the extension of the given file path.
+func FormatFromPath(path string) (Format, error) {
+	return ParseFormat(strings.TrimPrefix(filepath.Ext(path), "."))
+}
+
+// Load reads the YAML configuration from a reader and returns a Config struct.
 func (c *Config) Load(reader io.Reader) (*Config, error) {
+	return c.LoadFormat(reader, FormatYAML)
+}
+
+// LoadFormat reads the configuration in the given format from a reader and returns a Config struct.
+func (c *Config) LoadFormat(reader io.Reader, format Format) (*Config, error) {
 	data, err := io.ReadAll(reader)
 	if err != nil {
 		return nil, err
 	}
 	data = []byte(os.ExpandEnv(string(data)))
-	if err := yaml.Unmarshal(data, &c); err != nil {
-		return nil, err
+	switch format {
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &c); err != nil {
+			return nil, err
+		}
+	case FormatJSON:
+		if err := json.Unmarshal(data, c); err != nil {
+			return nil, err
+		}
+	case FormatTOML:
+		if err := toml.Unmarshal(data, c); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config format: %q", format)
 	}
 	return c, nil
 }
@@ -35,6 +35,16 @@ func TestIsEnableTLS(t *testing.T) {
 			item:     &Proxy{TLSCertPath: "cert", TLSKeyPath: "key"},
 			expected: true,
 		},
+		{
+			name:     "Certificates are not empty",
+			item:     &Proxy{TLS: TLS{Certificates: []Certificate{{CertPath: "cert", KeyPath: "key"}}}},
+			expected: true,
+		},
+		{
+			name:     "CertDir is not empty",
+			item:     &Proxy{TLS: TLS{CertDir: "certs"}},
+			expected: true,
+		},
 	}
 
 	for _, c := range cases {
@@ -94,6 +104,7 @@ log_level: -4
 			},
 		},
 		4,
+		nil,
 	}
 
 	actual := &Config{}
@@ -130,3 +141,209 @@ func TestLoadUnmarshalError(t *testing.T) {
 		t.Fatalf("Expected error, got nil")
 	}
 }
+
+func TestLoadFormat(t *testing.T) {
+	expected := &Config{
+		Proxy: Proxy{
+			Port:              "8080",
+			ReadHeaderTimeout: 2000,
+			ShutdownTimeout:   3000,
+			StaticFiles: []StaticFile{
+				{
+					Path: "/public/",
+					Dir:  "testdata/public",
+				},
+			},
+		},
+		Upstreams: []Upstream{
+			{
+				HostName: "backend1.local",
+				Target:   "http://backend1:8081",
+			},
+		},
+		LogLevel: -4,
+	}
+
+	cases := []struct {
+		name   string
+		format Format
+		data   string
+	}{
+		{
+			name:   "json",
+			format: FormatJSON,
+			data: `{
+  "proxy": {
+    "port": "8080",
+    "read_header_timeout": 2000,
+    "shutdown_timeout": 3000,
+    "static_files": [{"path": "/public/", "dir": "testdata/public"}]
+  },
+  "upstreams": [{"host_name": "backend1.local", "target": "http://backend1:8081"}],
+  "log_level": -4
+}`,
+		},
+		{
+			name:   "toml",
+			format: FormatTOML,
+			data: `
+log_level = -4
+
+[proxy]
+port = "8080"
+read_header_timeout = 2000
+shutdown_timeout = 3000
+
+[[proxy.static_files]]
+path = "/public/"
+dir = "testdata/public"
+
+[[upstreams]]
+host_name = "backend1.local"
+target = "http://backend1:8081"
+`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actual := &Config{}
+			if _, err := actual.LoadFormat(strings.NewReader(c.data), c.format); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !reflect.DeepEqual(expected, actual) {
+				t.Fatalf("Expected %+v, got %+v", expected, actual)
+			}
+		})
+	}
+}
+
+func TestLoadFormatError(t *testing.T) {
+	cases := []struct {
+		name   string
+		format Format
+		data   string
+	}{
+		{name: "invalid json", format: FormatJSON, data: "{"},
+		{name: "invalid toml", format: FormatTOML, data: "[proxy"},
+		{name: "unsupported format", format: Format("ini"), data: ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var cfg Config
+			if _, err := cfg.LoadFormat(strings.NewReader(c.data), c.format); err == nil {
+				t.Fatalf("Expected error, got nil")
+			}
+		})
+	}
+}
+
+func TestFormatFromPath(t *testing.T) {
+	cases := []struct {
+		path     string
+		expected Format
+		wantErr  bool
+	}{
+		{path: "config.yaml", expected: FormatYAML},
+		{path: "config.YML", expected: FormatYAML},
+		{path: "/etc/gondola/config.json", expected: FormatJSON},
+		{path: "config.toml", expected: FormatTOML},
+		{path: "config", wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			actual, err := FormatFromPath(c.path)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("Expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if actual != c.expected {
+				t.Fatalf("Expected %v, got %v", c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestNewConfig(t *testing.T) {
+	expected := &Config{
+		Proxy: Proxy{
+			Port:              "8080",
+			ReadHeaderTimeout: 2000,
+			ShutdownTimeout:   3000,
+			TLSCertPath:       "/path/to/cert",
+			TLSKeyPath:        "/path/to/key",
+			StaticFiles: []StaticFile{
+				{Path: "/public/", Dir: "testdata/public"},
+			},
+		},
+		Upstreams: []Upstream{
+			{HostName: "backend1.local", Target: "http://backend1:8081"},
+			{HostName: "backend2.local", Target: "http://backend2:8082"},
+		},
+		LogLevel: -4,
+	}
+
+	actual := NewConfig(
+		WithPort("8080"),
+		WithReadHeaderTimeout(2000),
+		WithShutdownTimeout(3000),
+		WithTLS("/path/to/cert", "/path/to/key"),
+		WithStaticFile(StaticFile{Path: "/public/", Dir: "testdata/public"}),
+		WithUpstream(Upstream{HostName: "backend1.local", Target: "http://backend1:8081"}),
+		WithUpstream(Upstream{HostName: "backend2.local", Target: "http://backend2:8082"}),
+		WithLogLevel(-4),
+	)
+
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("Expected %+v, got %+v", expected, actual)
+	}
+}
+
+func TestGetListeners(t *testing.T) {
+	cases := []struct {
+		name     string
+		item     *Proxy
+		expected []Listener
+	}{
+		{
+			name:     "port without TLS",
+			item:     &Proxy{Port: "8080"},
+			expected: []Listener{{Address: ":8080"}},
+		},
+		{
+			name:     "port with TLS",
+			item:     &Proxy{Port: "443", TLSCertPath: "cert", TLSKeyPath: "key"},
+			expected: []Listener{{Address: ":443", TLS: true}},
+		},
+		{
+			name: "listeners",
+			item: &Proxy{
+				Port: "8080",
+				Listeners: []Listener{
+					{Address: "0.0.0.0:80", RedirectToHTTPS: true},
+					{Address: "[::]:443", TLS: true},
+				},
+			},
+			expected: []Listener{
+				{Address: "0.0.0.0:80", RedirectToHTTPS: true},
+				{Address: "[::]:443", TLS: true},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actual := c.item.GetListeners()
+			if !reflect.DeepEqual(actual, c.expected) {
+				t.Fatalf("Expected %+v, got %+v", c.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package gondola
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// errNoTargets is returned when an upstream has no targets, e.g. before any target is discovered.
+var errNoTargets = errors.New("no targets are available for upstream")
+
+// discoverer finds the targets of an upstream.
+type discoverer interface {
+	// targets returns the targets currently found.
+	targets(ctx context.Context) ([]string, error)
+	// interval returns how often the targets are looked up again.
+	interval() time.Duration
+}
+
+// newDiscoverer returns the discoverer configured for the upstream, or nil if its targets are static.
+func newDiscoverer(u Upstream) (discoverer, error) {
+	if !isDiscovered(u) {
+		return nil, nil
+	}
+	if u.Target != "" || len(u.Targets) > 0 {
+		return nil, errors.New("target and targets must not be set with dns or file_discovery")
+	}
+	if u.DNS.Name != "" {
+		if u.FileDiscovery.Path != "" {
+			return nil, errors.New("dns and file_discovery must not be set together")
+		}
+		return newDNSDiscoverer(u.DNS)
+	}
+	return newFileDiscoverer(u.HostName, u.FileDiscovery)
+}
+
+// isDiscovered reports whether the targets of the upstream are discovered instead of configured.
+func isDiscovered(u Upstream) bool {
+	return u.DNS.Name != "" || u.FileDiscovery.Path != ""
+}
+
+// discover looks up the targets of the pool, and keeps looking them up at the interval of the discoverer until the context is cancelled.
+func (p *targetPool) discover(ctx context.Context) {
+	p.refresh(ctx)
+	go func() {
+		ticker := time.NewTicker(p.discoverer.interval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.refresh(ctx)
+			}
+		}
+	}()
+}
+
+// refresh replaces the targets of the pool with the targets found by the discoverer.
+// The current targets are kept if the lookup fails.
+func (p *targetPool) refresh(ctx context.Context) {
+	names, err := p.discoverer.targets(ctx)
+	if err == nil && len(names) == 0 {
+		err = errors.New("no targets found")
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("error discovering targets, keeping current targets: "+err.Error(), slog.String("host_name", p.hostName))
+		}
+		return
+	}
+	if err := p.setTargets(names); err != nil {
+		slog.Error("error updating targets, keeping current targets: "+err.Error(), slog.String("host_name", p.hostName))
+	}
+}
+
+// setTargets replaces the targets of the pool. Targets that remain keep their state, and new targets start warming up,
+// unless the pool had no targets.
+func (p *targetPool) setTargets(names []string) error {
+	p.mu.Lock()
+	current := make(map[string]*upstreamTarget, len(p.targets))
+	for _, t := range p.targets {
+		current[t.name] = t
+	}
+	p.mu.Unlock()
+
+	targets := make([]*upstreamTarget, 0, len(names))
+	var added, removed []string
+	for _, name := range names {
+		if t, ok := current[name]; ok {
+			targets = append(targets, t)
+			delete(current, name)
+			continue
+		}
+		t, err := p.newTarget(name)
+		if err != nil {
+			p.closeTargets(slices.DeleteFunc(targets, func(t *upstreamTarget) bool { return !slices.Contains(added, t.name) }))
+			return err
+		}
+		targets = append(targets, t)
+		added = append(added, name)
+	}
+	removedTargets := make([]*upstreamTarget, 0, len(current))
+	for name, t := range current {
+		removed = append(removed, name)
+		removedTargets = append(removedTargets, t)
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	slices.Sort(removed)
+
+	p.mu.Lock()
+	now := time.Now()
+	if len(p.targets) > 0 {
+		for _, t := range targets {
+			if slices.Contains(added, t.name) {
+				p.warmUp(t, now)
+			}
+		}
+	}
+	p.targets = targets
+	if p.affinity != nil {
+		p.affinity.build(targets)
+	}
+	p.mu.Unlock()
+	p.closeTargets(removedTargets)
+
+	slog.Info("targets_updated",
+		slog.String("host_name", p.hostName),
+		slog.Any("targets", names),
+		slog.Any("added", added),
+		slog.Any("removed", removed),
+	)
+	return nil
+}
+
+// startDiscovery starts discovering the targets of upstreams, and the upstreams of containers, until the context is cancelled.
+func (rt *router) startDiscovery(ctx context.Context) {
+	rt.mu.RLock()
+	for _, us := range rt.upstreams {
+		if us.pool.discoverer != nil {
+			us.pool.discover(ctx)
+		}
+	}
+	rt.mu.RUnlock()
+	if rt.docker != nil {
+		rt.watchDocker(ctx)
+	}
+}
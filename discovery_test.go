@@ -0,0 +1,97 @@
+package gondola
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewDiscoverer(t *testing.T) {
+	tests := []struct {
+		name          string
+		upstream      Upstream
+		expectedNil   bool
+		expectedError bool
+	}{
+		{name: "static", upstream: Upstream{Target: "http://localhost:8080"}, expectedNil: true},
+		{name: "dns", upstream: Upstream{DNS: DNSDiscovery{Name: "backend.internal", Port: 8080}}},
+		{name: "file", upstream: Upstream{FileDiscovery: FileDiscovery{Path: "targets.yaml"}}},
+		{name: "dns with target", upstream: Upstream{Target: "http://localhost:8080", DNS: DNSDiscovery{Name: "backend.internal", Port: 8080}}, expectedError: true},
+		{name: "file with targets", upstream: Upstream{Targets: []string{"http://localhost:8080"}, FileDiscovery: FileDiscovery{Path: "targets.yaml"}}, expectedError: true},
+		{name: "dns and file", upstream: Upstream{DNS: DNSDiscovery{Name: "backend.internal", Port: 8080}, FileDiscovery: FileDiscovery{Path: "targets.yaml"}}, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := newDiscoverer(tt.upstream)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if (actual == nil) != tt.expectedNil {
+				t.Errorf("Expected nil discoverer to be %v, got %v", tt.expectedNil, actual)
+			}
+		})
+	}
+}
+
+// idleCloser is a transport that records whether its idle connections were closed.
+type idleCloser struct {
+	http.RoundTripper
+	closed bool
+}
+
+func (c *idleCloser) CloseIdleConnections() {
+	c.closed = true
+}
+
+func TestSetTargetsClosesRemovedTargets(t *testing.T) {
+	var logs syncBuffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	defer slog.SetDefault(prev)
+
+	p, err := newTargetPool(Upstream{HostName: "backend.local", FileDiscovery: FileDiscovery{Path: "targets.yaml"}}, nil, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.setTargets([]string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	kept, removed := p.targets[0], p.targets[1]
+	keptTransport, removedTransport := &idleCloser{}, &idleCloser{}
+	kept.transport, removed.transport = keptTransport, removedTransport
+
+	// The removed target is ejected and waiting to be re-admitted.
+	p.mu.Lock()
+	removed.health.ejected = true
+	removed.health.readmitTimer = time.AfterFunc(50*time.Millisecond, func() { p.readmit(removed) })
+	p.mu.Unlock()
+
+	if err := p.setTargets([]string{"http://10.0.0.1:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	if !removedTransport.closed {
+		t.Error("Expected idle connections of the removed target to be closed")
+	}
+	if keptTransport.closed {
+		t.Error("Expected idle connections of the kept target to stay open")
+	}
+
+	// A re-admission that was already due does not return the removed target either.
+	p.readmit(removed)
+	time.Sleep(100 * time.Millisecond)
+	if strings.Contains(logs.String(), `"msg":"target_readmitted"`) {
+		t.Errorf("Expected removed target not to be re-admitted, got %s", logs.String())
+	}
+	if len(p.targets) != 1 || p.targets[0] != kept {
+		t.Errorf("Expected only the kept target to remain, got %d targets", len(p.targets))
+	}
+}
@@ -0,0 +1,126 @@
+package gondola
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// dnsTypeA looks up the A and AAAA records of a name.
+	dnsTypeA = "a"
+	// dnsTypeSRV looks up the SRV records of a name.
+	dnsTypeSRV = "srv"
+
+	defaultDNSInterval = 30 * time.Second
+	// dnsLookupTimeout is the timeout of each lookup.
+	dnsLookupTimeout = 5 * time.Second
+)
+
+// dnsDiscoverer finds the targets of an upstream from DNS records.
+type dnsDiscoverer struct {
+	config   DNSDiscovery
+	resolver *net.Resolver
+	every    time.Duration
+}
+
+// newDNSDiscoverer validates the DNS discovery configuration.
+func newDNSDiscoverer(c DNSDiscovery) (*dnsDiscoverer, error) {
+	d := &dnsDiscoverer{
+		config:   c,
+		resolver: net.DefaultResolver,
+		every:    time.Duration(c.Interval) * time.Millisecond,
+	}
+	if d.config.Type == "" {
+		d.config.Type = dnsTypeA
+	}
+	if d.config.Scheme == "" {
+		d.config.Scheme = "http"
+	}
+	switch d.config.Type {
+	case dnsTypeA:
+		if c.Port <= 0 || c.Port > 65535 {
+			return nil, fmt.Errorf("invalid dns port: %d", c.Port)
+		}
+	case dnsTypeSRV:
+		if c.Port != 0 {
+			return nil, errors.New("dns port must not be set for srv records, which have their own ports")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported dns type: %s", c.Type)
+	}
+	if d.config.Scheme != "http" && d.config.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported dns scheme: %s", c.Scheme)
+	}
+	if c.Interval < 0 {
+		return nil, fmt.Errorf("invalid dns interval: %d", c.Interval)
+	}
+	if d.every == 0 {
+		d.every = defaultDNSInterval
+	}
+	if c.Resolver != "" {
+		if _, _, err := net.SplitHostPort(c.Resolver); err != nil {
+			return nil, fmt.Errorf("invalid dns resolver %s: %w", c.Resolver, err)
+		}
+		d.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, c.Resolver)
+			},
+		}
+	}
+	return d, nil
+}
+
+// interval implements the discoverer interface.
+func (d *dnsDiscoverer) interval() time.Duration {
+	return d.every
+}
+
+// targets implements the discoverer interface.
+// A and AAAA records become targets with the configured port. SRV records of the lowest priority become targets
+// with their own host and port.
+func (d *dnsDiscoverer) targets(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+	defer cancel()
+
+	var hostPorts []string
+	switch d.config.Type {
+	case dnsTypeSRV:
+		_, records, err := d.resolver.LookupSRV(ctx, "", "", d.config.Name)
+		if err != nil {
+			return nil, err
+		}
+		if len(records) > 0 {
+			priority := records[0].Priority // records are sorted by priority
+			for _, r := range records {
+				if r.Priority != priority {
+					break
+				}
+				host := strings.TrimSuffix(r.Target, ".")
+				hostPorts = append(hostPorts, net.JoinHostPort(host, strconv.Itoa(int(r.Port))))
+			}
+		}
+	default:
+		addrs, err := d.resolver.LookupNetIP(ctx, "ip", d.config.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			hostPorts = append(hostPorts, net.JoinHostPort(addr.Unmap().String(), strconv.Itoa(d.config.Port)))
+		}
+	}
+
+	targets := make([]string, 0, len(hostPorts))
+	for _, hp := range hostPorts {
+		targets = append(targets, d.config.Scheme+"://"+hp)
+	}
+	slices.Sort(targets)
+	return slices.Compact(targets), nil
+}
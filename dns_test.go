@@ -0,0 +1,277 @@
+package gondola
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsServer is an in-process DNS server that answers A, AAAA and SRV questions from its records.
+type dnsServer struct {
+	addr string
+
+	mu      sync.Mutex
+	a       []netip.Addr
+	srv     []net.SRV
+	failing bool
+}
+
+// newDNSServer starts a DNS server on a local UDP port.
+func newDNSServer(t *testing.T) *dnsServer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s := &dnsServer{addr: conn.LocalAddr().String()}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp, err := s.answer(buf[:n]); err == nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return s
+}
+
+func (s *dnsServer) set(a []netip.Addr, srv []net.SRV, failing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.a, s.srv, s.failing = a, srv, failing
+}
+
+func (s *dnsServer) answer(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h.Response = true
+	h.Authoritative = true
+	if s.failing {
+		h.RCode = dnsmessage.RCodeServerFailure
+	}
+	b := dnsmessage.NewBuilder(nil, h)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 1}
+	if !s.failing {
+		switch q.Type {
+		case dnsmessage.TypeA:
+			for _, a := range s.a {
+				if a.Is4() {
+					err = b.AResource(rh, dnsmessage.AResource{A: a.As4()})
+				}
+			}
+		case dnsmessage.TypeAAAA:
+			for _, a := range s.a {
+				if a.Is6() {
+					err = b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: a.As16()})
+				}
+			}
+		case dnsmessage.TypeSRV:
+			for _, r := range s.srv {
+				err = b.SRVResource(rh, dnsmessage.SRVResource{
+					Priority: r.Priority,
+					Weight:   r.Weight,
+					Port:     r.Port,
+					Target:   dnsmessage.MustNewName(r.Target),
+				})
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+func TestNewDNSDiscoverer(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        DNSDiscovery
+		expected      DNSDiscovery
+		expectedEvery time.Duration
+		expectedError bool
+	}{
+		{
+			name:          "defaults",
+			config:        DNSDiscovery{Name: "backend.internal", Port: 8080},
+			expected:      DNSDiscovery{Name: "backend.internal", Type: dnsTypeA, Port: 8080, Scheme: "http"},
+			expectedEvery: defaultDNSInterval,
+		},
+		{
+			name:          "srv",
+			config:        DNSDiscovery{Name: "_http._tcp.backend.internal", Type: dnsTypeSRV, Scheme: "https", Resolver: "127.0.0.1:53", Interval: 1000},
+			expected:      DNSDiscovery{Name: "_http._tcp.backend.internal", Type: dnsTypeSRV, Scheme: "https", Resolver: "127.0.0.1:53", Interval: 1000},
+			expectedEvery: time.Second,
+		},
+		{name: "missing port", config: DNSDiscovery{Name: "backend.internal"}, expectedError: true},
+		{name: "port with srv", config: DNSDiscovery{Name: "backend.internal", Type: dnsTypeSRV, Port: 8080}, expectedError: true},
+		{name: "unsupported type", config: DNSDiscovery{Name: "backend.internal", Type: "mx", Port: 8080}, expectedError: true},
+		{name: "unsupported scheme", config: DNSDiscovery{Name: "backend.internal", Port: 8080, Scheme: "ftp"}, expectedError: true},
+		{name: "negative interval", config: DNSDiscovery{Name: "backend.internal", Port: 8080, Interval: -1}, expectedError: true},
+		{name: "resolver without port", config: DNSDiscovery{Name: "backend.internal", Port: 8080, Resolver: "127.0.0.1"}, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := newDNSDiscoverer(tt.config)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if actual.config != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, actual.config)
+			}
+			if actual.interval() != tt.expectedEvery {
+				t.Errorf("Expected interval %v, got %v", tt.expectedEvery, actual.interval())
+			}
+		})
+	}
+}
+
+func TestDNSDiscovererTargets(t *testing.T) {
+	s := newDNSServer(t)
+
+	tests := []struct {
+		name          string
+		config        DNSDiscovery
+		a             []netip.Addr
+		srv           []net.SRV
+		expected      []string
+		expectedError bool
+	}{
+		{
+			name:     "a and aaaa",
+			config:   DNSDiscovery{Name: "backend.internal.", Port: 8080},
+			a:        []netip.Addr{netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00::1")},
+			expected: []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080", "http://[fd00::1]:8080"},
+		},
+		{
+			name:   "srv of the lowest priority",
+			config: DNSDiscovery{Name: "_http._tcp.backend.internal.", Type: dnsTypeSRV, Scheme: "https"},
+			srv: []net.SRV{
+				{Target: "b.backend.internal.", Port: 8443, Priority: 10, Weight: 1},
+				{Target: "a.backend.internal.", Port: 8443, Priority: 10, Weight: 1},
+				{Target: "backup.backend.internal.", Port: 9443, Priority: 20, Weight: 1},
+			},
+			expected: []string{"https://a.backend.internal:8443", "https://b.backend.internal:8443"},
+		},
+		{name: "no records", config: DNSDiscovery{Name: "backend.internal.", Port: 8080}, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.set(tt.a, tt.srv, false)
+			tt.config.Resolver = s.addr
+			d, err := newDNSDiscoverer(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := d.targets(context.Background())
+			if tt.expectedError {
+				if err == nil {
+					t.Errorf("Expected error but got targets %v", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !slices.Equal(actual, tt.expected) {
+				t.Errorf("Expected targets %v, got %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	// SRV records are used so that each backend can have its own port. IP addresses are not valid SRV targets.
+	srvOf := func(servers ...*httptest.Server) []net.SRV {
+		var records []net.SRV
+		for _, s := range servers {
+			u, _ := url.Parse(s.URL)
+			port, _ := strconv.Atoi(u.Port())
+			records = append(records, net.SRV{Target: "localhost.", Port: uint16(port), Priority: 10, Weight: 1})
+		}
+		return records
+	}
+	a := newStatusServer(t, "a", 200)
+	b := newStatusServer(t, "b", 200)
+	s := newDNSServer(t)
+	s.set(nil, srvOf(a), false)
+
+	p, err := newTargetPool(Upstream{
+		HostName: "backend.local",
+		DNS:      DNSDiscovery{Name: "_http._tcp.backend.internal.", Type: dnsTypeSRV, Resolver: s.addr, Interval: 60000},
+	}, nil, slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.pick(httptest.NewRequest("GET", "http://backend.local/", nil), nil); err != errNoTargets {
+		t.Errorf("Expected errNoTargets before discovery, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.discover(ctx)
+	if names := roundTripNames(t, p, 4); slices.Contains(names, "b") {
+		t.Errorf("Expected only a to be discovered, got %v", names)
+	}
+
+	s.set(nil, srvOf(a, b), false)
+	p.refresh(ctx)
+	if names := roundTripNames(t, p, 4); !slices.Contains(names, "a") || !slices.Contains(names, "b") {
+		t.Errorf("Expected a and b to be discovered, got %v", names)
+	}
+
+	s.set(nil, nil, true)
+	p.refresh(ctx)
+	if names := roundTripNames(t, p, 4); !slices.Contains(names, "a") || !slices.Contains(names, "b") {
+		t.Errorf("Expected targets to be kept when the lookup fails, got %v", names)
+	}
+
+	s.set(nil, srvOf(b), false)
+	p.refresh(ctx)
+	if names := roundTripNames(t, p, 4); slices.Contains(names, "a") {
+		t.Errorf("Expected a to be removed, got %v", names)
+	}
+}
@@ -0,0 +1,232 @@
+package gondola
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	// dockerHostLabel is the container label with the host name of the upstream.
+	dockerHostLabel = "gondola.host"
+	// dockerPortLabel is the container label with the port the container listens on.
+	dockerPortLabel = "gondola.port"
+
+	defaultDockerEndpoint = "unix:///var/run/docker.sock"
+	defaultDockerInterval = 5 * time.Second
+	// dockerRequestTimeout is the timeout of each request to the Docker Engine API.
+	dockerRequestTimeout = 10 * time.Second
+)
+
+// dockerContainer is a container listed by the Docker Engine API.
+type dockerContainer struct {
+	ID              string            `json:"Id"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// dockerProvider finds upstreams from the labels of running containers.
+type dockerProvider struct {
+	client  *http.Client
+	baseURL string
+	network string
+	every   time.Duration
+}
+
+// newDockerProvider creates a provider that reads the Docker Engine API at the endpoint of the configuration.
+func newDockerProvider(c Docker) (*dockerProvider, error) {
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = defaultDockerEndpoint
+	}
+	if c.Interval < 0 {
+		return nil, fmt.Errorf("invalid docker interval: %d", c.Interval)
+	}
+	p := &dockerProvider{
+		client:  &http.Client{Timeout: dockerRequestTimeout},
+		network: c.Network,
+		every:   time.Duration(c.Interval) * time.Millisecond,
+	}
+	if p.every == 0 {
+		p.every = defaultDockerInterval
+	}
+
+	if path, ok := unixSocketPath(endpoint); ok {
+		if path == "" {
+			return nil, fmt.Errorf("invalid docker endpoint: %s", endpoint)
+		}
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.DialContext = dialUnix(path)
+		p.client.Transport = tr
+		p.baseURL = "http://" + unixSocketHost
+		return p, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid docker endpoint: %s", endpoint)
+	}
+	switch u.Scheme {
+	case "tcp", "http":
+		p.baseURL = "http://" + u.Host
+	default:
+		return nil, fmt.Errorf("unsupported docker endpoint scheme: %s", u.Scheme)
+	}
+	return p, nil
+}
+
+// containers returns the running containers with the host label.
+func (p *dockerProvider) containers(ctx context.Context) ([]dockerContainer, error) {
+	filters, err := json.Marshal(map[string][]string{"label": {dockerHostLabel}})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.baseURL+"/containers/json?filters="+url.QueryEscape(string(filters)), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from docker: %s", res.Status)
+	}
+	var containers []dockerContainer
+	if err := json.NewDecoder(res.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("error decoding containers: %w", err)
+	}
+	return containers, nil
+}
+
+// upstreams returns the targets of the running containers by the host name in their labels.
+// Containers with an invalid port or without an address are skipped.
+func (p *dockerProvider) upstreams(ctx context.Context) (map[string][]string, error) {
+	containers, err := p.containers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	upstreams := make(map[string][]string)
+	for _, c := range containers {
+		host := c.Labels[dockerHostLabel]
+		if host == "" {
+			continue
+		}
+		port, err := strconv.Atoi(c.Labels[dockerPortLabel])
+		if err != nil || port <= 0 || port > 65535 {
+			slog.Warn("container is skipped, "+dockerPortLabel+" label must be a port number",
+				slog.String("container_id", shortContainerID(c.ID)),
+				slog.String("host_name", host),
+			)
+			continue
+		}
+		ip := p.containerIP(c)
+		if ip == "" {
+			slog.Warn("container is skipped, it has no IP address",
+				slog.String("container_id", shortContainerID(c.ID)),
+				slog.String("host_name", host),
+			)
+			continue
+		}
+		upstreams[host] = append(upstreams[host], "http://"+net.JoinHostPort(ip, strconv.Itoa(port)))
+	}
+	for host, targets := range upstreams {
+		slices.Sort(targets)
+		upstreams[host] = slices.Compact(targets)
+	}
+	return upstreams, nil
+}
+
+// containerIP returns the IP address of the container in the configured network, or in the first of its networks by name.
+func (p *dockerProvider) containerIP(c dockerContainer) string {
+	networks := c.NetworkSettings.Networks
+	if p.network != "" {
+		return networks[p.network].IPAddress
+	}
+	for _, name := range slices.Sorted(maps.Keys(networks)) {
+		if ip := networks[name].IPAddress; ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
+
+// shortContainerID returns the first 12 characters of the container ID like the docker CLI.
+func shortContainerID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// watchDocker updates the upstreams from the containers, and keeps updating them at the interval of the provider
+// until the context is cancelled.
+func (rt *router) watchDocker(ctx context.Context) {
+	rt.syncDocker(ctx)
+	go func() {
+		ticker := time.NewTicker(rt.docker.every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				rt.syncDocker(ctx)
+			}
+		}
+	}()
+}
+
+// syncDocker adds, updates and removes the upstreams of containers. Configured upstreams take precedence over containers.
+// The current upstreams are kept if the containers cannot be listed. Removed upstreams release their targets.
+func (rt *router) syncDocker(ctx context.Context) {
+	found, err := rt.docker.upstreams(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("error listing docker containers, keeping current upstreams: " + err.Error())
+		}
+		return
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for host, targets := range found {
+		if us, ok := rt.upstreams[host]; ok {
+			if !rt.dockerHosts[host] {
+				continue
+			}
+			if err := us.pool.setTargets(targets); err != nil {
+				slog.Error("error updating upstream from docker: "+err.Error(), slog.String("host_name", host))
+			}
+			continue
+		}
+		us, err := newUpstream(rt.config, Upstream{HostName: host, Targets: targets}, rt.budget, rt.logger)
+		if err != nil {
+			slog.Error("error adding upstream from docker: "+err.Error(), slog.String("host_name", host))
+			continue
+		}
+		rt.upstreams[host] = us
+		rt.dockerHosts[host] = true
+		slog.Info("upstream_added", slog.String("host_name", host), slog.Any("targets", targets))
+	}
+	for host := range rt.dockerHosts {
+		if _, ok := found[host]; !ok {
+			rt.upstreams[host].pool.close()
+			delete(rt.upstreams, host)
+			delete(rt.dockerHosts, host)
+			slog.Info("upstream_removed", slog.String("host_name", host))
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package gondola
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dockerServer is a fake Docker Engine API that lists its containers over a unix domain socket.
+type dockerServer struct {
+	endpoint string
+
+	mu         sync.Mutex
+	containers []dockerContainer
+	failing    bool
+}
+
+// newDockerServer starts a fake Docker Engine API.
+func newDockerServer(t *testing.T) *dockerServer {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "docker.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &dockerServer{endpoint: "unix://" + path}
+	s := &httptest.Server{Listener: ln, Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var filters map[string][]string
+		if r.URL.Path != "/containers/json" || json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters) != nil ||
+			!slices.Equal(filters["label"], []string{dockerHostLabel}) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(d.containers)
+	})}}
+	s.Start()
+	t.Cleanup(s.Close)
+	return d
+}
+
+func (d *dockerServer) set(containers []dockerContainer, failing bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.containers, d.failing = containers, failing
+}
+
+// newContainer returns a container with the labels and an address in the network.
+func newContainer(id, host, port, network, ip string) dockerContainer {
+	c := dockerContainer{ID: id, Labels: map[string]string{dockerHostLabel: host, dockerPortLabel: port}}
+	c.NetworkSettings.Networks = map[string]struct {
+		IPAddress string `json:"IPAddress"`
+	}{network: {IPAddress: ip}}
+	return c
+}
+
+// containerOf returns a container whose address is the backend.
+func containerOf(t *testing.T, id, host string, backend *httptest.Server) dockerContainer {
+	t.Helper()
+	u, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newContainer(id, host, u.Port(), "bridge", u.Hostname())
+}
+
+func TestNewDockerProvider(t *testing.T) {
+	tests := []struct {
+		name            string
+		config          Docker
+		expectedBaseURL string
+		expectedEvery   time.Duration
+		expectedError   bool
+	}{
+		{name: "defaults", config: Docker{Enabled: true}, expectedBaseURL: "http://" + unixSocketHost, expectedEvery: defaultDockerInterval},
+		{name: "tcp", config: Docker{Enabled: true, Endpoint: "tcp://127.0.0.1:2375", Interval: 1000}, expectedBaseURL: "http://127.0.0.1:2375", expectedEvery: time.Second},
+		{name: "empty socket path", config: Docker{Enabled: true, Endpoint: "unix://"}, expectedError: true},
+		{name: "unsupported scheme", config: Docker{Enabled: true, Endpoint: "ssh://docker.internal"}, expectedError: true},
+		{name: "negative interval", config: Docker{Enabled: true, Interval: -1}, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := newDockerProvider(tt.config)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if actual.baseURL != tt.expectedBaseURL {
+				t.Errorf("Expected base URL %s, got %s", tt.expectedBaseURL, actual.baseURL)
+			}
+			if actual.every != tt.expectedEvery {
+				t.Errorf("Expected interval %v, got %v", tt.expectedEvery, actual.every)
+			}
+		})
+	}
+}
+
+func TestDockerUpstreams(t *testing.T) {
+	d := newDockerServer(t)
+	d.set([]dockerContainer{
+		newContainer("b1", "backend1.local", "8081", "bridge", "172.17.0.3"),
+		newContainer("b2", "backend1.local", "8081", "bridge", "172.17.0.2"),
+		newContainer("b3", "backend2.local", "8082", "bridge", "172.17.0.4"),
+		newContainer("b4", "backend2.local", "http", "bridge", "172.17.0.5"),
+		newContainer("b5", "backend2.local", "8082", "bridge", ""),
+		newContainer("b6", "backend3.local", "8083", "app", "10.0.0.2"),
+	}, false)
+
+	tests := []struct {
+		name     string
+		network  string
+		expected map[string][]string
+	}{
+		{
+			name: "any network",
+			expected: map[string][]string{
+				"backend1.local": {"http://172.17.0.2:8081", "http://172.17.0.3:8081"},
+				"backend2.local": {"http://172.17.0.4:8082"},
+				"backend3.local": {"http://10.0.0.2:8083"},
+			},
+		},
+		{
+			name:     "network",
+			network:  "app",
+			expected: map[string][]string{"backend3.local": {"http://10.0.0.2:8083"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newDockerProvider(Docker{Enabled: true, Endpoint: d.endpoint, Network: tt.network})
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := p.upstreams(context.Background())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Errorf("Expected upstreams %v, got %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestDockerDiscovery(t *testing.T) {
+	a := newStatusServer(t, "a", http.StatusOK)
+	b := newStatusServer(t, "b", http.StatusOK)
+	configured := newStatusServer(t, "configured", http.StatusOK)
+	d := newDockerServer(t)
+	d.set([]dockerContainer{
+		containerOf(t, "a", "backend1.local", a),
+		containerOf(t, "c", "configured.local", a),
+	}, false)
+
+	rt, err := newRouter(&Config{
+		Proxy:     Proxy{Docker: Docker{Enabled: true, Endpoint: d.endpoint, Interval: 60000}},
+		Upstreams: []Upstream{{HostName: "configured.local", Target: configured.URL}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rt.startDiscovery(ctx)
+
+	// names sends n requests for the host and returns the names of the backends that responded.
+	names := func(host string, n int) []string {
+		t.Helper()
+		var names []string
+		for range n {
+			req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+			rec := httptest.NewRecorder()
+			rt.ServeHTTP(rec, req)
+			body, _ := io.ReadAll(rec.Body)
+			names = append(names, string(body))
+		}
+		return names
+	}
+
+	if actual := names("backend1.local", 2); !slices.Equal(actual, []string{"a", "a"}) {
+		t.Errorf("Expected the container to be added, got %v", actual)
+	}
+	if actual := names("configured.local", 1); !slices.Equal(actual, []string{"configured"}) {
+		t.Errorf("Expected the configured upstream to take precedence, got %v", actual)
+	}
+
+	d.set([]dockerContainer{
+		containerOf(t, "a", "backend1.local", a),
+		containerOf(t, "b", "backend1.local", b),
+	}, false)
+	rt.syncDocker(ctx)
+	if actual := names("backend1.local", 4); !slices.Contains(actual, "a") || !slices.Contains(actual, "b") {
+		t.Errorf("Expected the started container to be added, got %v", actual)
+	}
+
+	d.set(nil, true)
+	rt.syncDocker(ctx)
+	if actual := names("backend1.local", 4); !slices.Contains(actual, "a") || !slices.Contains(actual, "b") {
+		t.Errorf("Expected upstreams to be kept when docker fails, got %v", actual)
+	}
+
+	d.set([]dockerContainer{containerOf(t, "b", "backend1.local", b)}, false)
+	rt.syncDocker(ctx)
+	if actual := names("backend1.local", 4); slices.Contains(actual, "a") {
+		t.Errorf("Expected the stopped container to be removed, got %v", actual)
+	}
+
+	transport := &idleCloser{}
+	rt.upstreams["backend1.local"].pool.targets[0].transport = transport
+	d.set(nil, false)
+	rt.syncDocker(ctx)
+	if actual := strings.Join(names("backend1.local", 1), ""); actual != "" {
+		t.Errorf("Expected the upstream to be removed, got %s", actual)
+	}
+	if !transport.closed {
+		t.Error("Expected idle connections of the removed upstream to be closed")
+	}
+	if actual := names("configured.local", 1); !slices.Equal(actual, []string{"configured"}) {
+		t.Errorf("Expected the configured upstream to be kept, got %v", actual)
+	}
+}
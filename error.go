@@ -2,13 +2,18 @@ package gondola
 
 import (
 	"fmt"
-	"net/http"
+	"sync"
 )
 
 // Gondola is a proxy server.
 type Gondola struct {
-	config *Config
-	server *http.Server
+	config    *Config
+	listeners []*listener
+	streams   []*streamProxy
+	router    *router
+	acme      *acmeManager
+	reload    chan struct{} // requests to reload the certificates
+	start     sync.Once     // starts discovery only once
 }
 
 // ConfigLoadError is an error that occurs when loading the configuration.
@@ -0,0 +1,368 @@
+package gondola
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FastCGI record types and roles, see https://fastcgi-archives.github.io/FastCGI_Specification.html.
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+	fcgiResponder    = 1
+
+	// fcgiRequestID is the ID of the request, as each connection serves a single request.
+	fcgiRequestID = 1
+	// fcgiMaxContent is the maximum content length of a record.
+	fcgiMaxContent = 65535
+	// fcgiDialTimeout is the timeout to connect to a FastCGI server.
+	fcgiDialTimeout = 10 * time.Second
+)
+
+const (
+	defaultFastCGISplitPath = ".php"
+	defaultFastCGIIndex     = "index.php"
+)
+
+// fastCGITransport is a http.RoundTripper that sends requests to a FastCGI server.
+type fastCGITransport struct {
+	config  FastCGI
+	network string
+	addr    string
+}
+
+// newFastCGITransport creates a FastCGI transport for a tcp target such as tcp://127.0.0.1:9000 or a unix domain socket.
+func newFastCGITransport(c FastCGI, target *url.URL, socketPath string) (*fastCGITransport, error) {
+	t := &fastCGITransport{config: c, network: "unix", addr: socketPath}
+	if socketPath == "" {
+		if target.Scheme != "tcp" || target.Host == "" {
+			return nil, fmt.Errorf("target must be tcp://host:port or unix:///path, got %s", target)
+		}
+		t.network, t.addr = "tcp", target.Host
+	}
+	if t.config.SplitPath == "" {
+		t.config.SplitPath = defaultFastCGISplitPath
+	}
+	if t.config.Index == "" {
+		t.config.Index = defaultFastCGIIndex
+	}
+	return t, nil
+}
+
+// RoundTrip implements the RoundTripper interface.
+// The response body is streamed from the FastCGI server as it writes to stdout.
+func (t *fastCGITransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	d := net.Dialer{Timeout: fcgiDialTimeout}
+	conn, err := d.DialContext(r.Context(), t.network, t.addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(r.Context(), func() { conn.Close() })
+	closeConn := func() {
+		stop()
+		conn.Close()
+	}
+
+	w := &fcgiWriter{w: bufio.NewWriter(conn)}
+	begin := []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}
+	if err := w.writeRecord(fcgiBeginRequest, begin); err != nil {
+		closeConn()
+		return nil, err
+	}
+	if err := w.writeStream(fcgiParams, encodeParams(t.params(r))); err != nil {
+		closeConn()
+		return nil, err
+	}
+	if err := w.flush(); err != nil {
+		closeConn()
+		return nil, err
+	}
+
+	// The request body is sent while the response is read, so that neither side blocks the other.
+	go func() {
+		if err := w.copyStdin(r.Body); err != nil {
+			conn.Close()
+		}
+	}()
+
+	pr, pw := io.Pipe()
+	go readRecords(conn, pw, r)
+
+	br := bufio.NewReader(pr)
+	header, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		pr.Close()
+		closeConn()
+		return nil, fmt.Errorf("error reading FastCGI response header: %w", err)
+	}
+
+	res := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header(header),
+		ContentLength: -1,
+		Request:       r,
+		Body: &fcgiBody{Reader: br, close: func() {
+			pr.Close()
+			closeConn()
+		}},
+	}
+	if status := header.Get("Status"); status != "" {
+		code, err := strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+		if err != nil || code < 100 || code > 999 {
+			res.Body.Close()
+			return nil, fmt.Errorf("invalid FastCGI response status %q", status)
+		}
+		res.StatusCode = code
+		res.Status = status
+		res.Header.Del("Status")
+	} else if header.Get("Location") != "" {
+		res.StatusCode = http.StatusFound
+		res.Status = "302 Found"
+	}
+	if cl, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		res.ContentLength = cl
+	}
+	return res, nil
+}
+
+// params returns the CGI parameters of the request.
+func (t *fastCGITransport) params(r *http.Request) map[string]string {
+	scriptName, pathInfo := t.splitPath(r.URL.Path)
+
+	serverName, serverPort := hostWithoutPort(r.Host), ""
+	if _, port, err := net.SplitHostPort(r.Host); err == nil {
+		serverPort = port
+	} else if r.TLS != nil {
+		serverPort = "443"
+	} else {
+		serverPort = "80"
+	}
+	remoteAddr, remotePort, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteAddr = r.RemoteAddr
+	}
+
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "gondola",
+		"SERVER_PROTOCOL":   r.Proto,
+		"SERVER_NAME":       serverName,
+		"SERVER_PORT":       serverPort,
+		"REMOTE_ADDR":       remoteAddr,
+		"REMOTE_PORT":       remotePort,
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.URL.RequestURI(),
+		"QUERY_STRING":      r.URL.RawQuery,
+		"DOCUMENT_ROOT":     t.config.Root,
+		"SCRIPT_NAME":       scriptName,
+		"SCRIPT_FILENAME":   path.Join(t.config.Root, scriptName),
+		"PATH_INFO":         pathInfo,
+		"CONTENT_TYPE":      r.Header.Get("Content-Type"),
+		"CONTENT_LENGTH":    "",
+	}
+	if r.ContentLength >= 0 {
+		params["CONTENT_LENGTH"] = strconv.FormatInt(r.ContentLength, 10)
+	}
+	if r.TLS != nil {
+		params["HTTPS"] = "on"
+	}
+	if r.Host != "" {
+		params["HTTP_HOST"] = r.Host
+	}
+	for k, v := range r.Header {
+		if k == "Content-Type" || k == "Content-Length" || k == "Proxy" {
+			continue // Proxy is dropped to prevent httpoxy
+		}
+		if strings.Contains(k, "_") {
+			continue // X-Foo_Bar would be indistinguishable from X-Foo-Bar, as in nginx and Apache
+		}
+		params["HTTP_"+strings.ReplaceAll(strings.ToUpper(k), "-", "_")] = strings.Join(v, ", ")
+	}
+	for k, v := range t.config.Params {
+		params[k] = v
+	}
+	return params
+}
+
+// splitPath splits the request path into SCRIPT_NAME and PATH_INFO at the split extension.
+// Paths ending with "/" are served by the index script in the directory, and other paths by the index script in the root.
+func (t *fastCGITransport) splitPath(p string) (string, string) {
+	dir := strings.HasSuffix(p, "/")
+	p = path.Clean("/" + p)
+	lower := strings.ToLower(p)
+	ext := strings.ToLower(t.config.SplitPath)
+	for i := 0; ; {
+		j := strings.Index(lower[i:], ext)
+		if j < 0 {
+			break
+		}
+		end := i + j + len(ext)
+		if end == len(p) || p[end] == '/' {
+			return p[:end], p[end:]
+		}
+		i = end
+	}
+	if dir {
+		return path.Join(p, t.config.Index), ""
+	}
+	return "/" + t.config.Index, ""
+}
+
+// fcgiWriter writes FastCGI records.
+type fcgiWriter struct {
+	w *bufio.Writer
+}
+
+func (w *fcgiWriter) writeRecord(recType byte, content []byte) error {
+	padding := byte(-len(content) & 7)
+	header := [8]byte{fcgiVersion, recType, 0, fcgiRequestID, 0, 0, padding, 0}
+	binary.BigEndian.PutUint16(header[4:], uint16(len(content)))
+	if _, err := w.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(content); err != nil {
+		return err
+	}
+	_, err := w.w.Write(make([]byte, padding))
+	return err
+}
+
+// writeStream writes content as a stream of records terminated by an empty record.
+func (w *fcgiWriter) writeStream(recType byte, content []byte) error {
+	for len(content) > 0 {
+		n := min(len(content), fcgiMaxContent)
+		if err := w.writeRecord(recType, content[:n]); err != nil {
+			return err
+		}
+		content = content[n:]
+	}
+	return w.writeRecord(recType, nil)
+}
+
+func (w *fcgiWriter) flush() error {
+	return w.w.Flush()
+}
+
+// copyStdin streams the request body as stdin records.
+func (w *fcgiWriter) copyStdin(body io.Reader) error {
+	if body != nil {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := body.Read(buf)
+			if n > 0 {
+				if werr := w.writeRecord(fcgiStdin, buf[:n]); werr != nil {
+					return werr
+				}
+				if werr := w.flush(); werr != nil {
+					return werr
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := w.writeRecord(fcgiStdin, nil); err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+// encodeParams encodes the parameters as FastCGI name-value pairs.
+func encodeParams(params map[string]string) []byte {
+	var b bytes.Buffer
+	writeLen := func(n int) {
+		if n < 128 {
+			b.WriteByte(byte(n))
+			return
+		}
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(n)|1<<31)
+		b.Write(l[:])
+	}
+	for k, v := range params {
+		writeLen(len(k))
+		writeLen(len(v))
+		b.WriteString(k)
+		b.WriteString(v)
+	}
+	return b.Bytes()
+}
+
+// readRecords reads the records of the response and writes stdout to pw until the request ends.
+// Stderr of the FastCGI server is logged.
+func readRecords(conn net.Conn, pw *io.PipeWriter, r *http.Request) {
+	br := bufio.NewReader(conn)
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			pw.CloseWithError(fmt.Errorf("error reading FastCGI record: %w", err))
+			return
+		}
+		recType := header[1]
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		padding := int(header[6])
+		content := make([]byte, length+padding)
+		if _, err := io.ReadFull(br, content); err != nil {
+			pw.CloseWithError(fmt.Errorf("error reading FastCGI record: %w", err))
+			return
+		}
+		content = content[:length]
+
+		switch recType {
+		case fcgiStdout:
+			if _, err := pw.Write(content); err != nil {
+				return
+			}
+		case fcgiStderr:
+			if len(content) > 0 {
+				slog.WarnContext(r.Context(), "FastCGI stderr: "+strings.TrimSpace(string(content)),
+					slog.String("host", r.Host),
+					slog.String("request_uri", r.URL.RequestURI()),
+				)
+			}
+		case fcgiEndRequest:
+			pw.Close()
+			return
+		}
+	}
+}
+
+// fcgiBody is the body of a FastCGI response, which closes the connection when closed.
+type fcgiBody struct {
+	io.Reader
+	once  sync.Once
+	close func()
+}
+
+func (b *fcgiBody) Close() error {
+	b.once.Do(b.close)
+	return nil
+}
@@ -0,0 +1,247 @@
+package gondola
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newFastCGIServer starts a FastCGI responder that echoes the CGI parameters and the request body.
+func newFastCGIServer(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go fcgi.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env := fcgi.ProcessEnv(r)
+		w.Header().Set("X-Script-Filename", env["SCRIPT_FILENAME"])
+		w.Header().Set("X-Document-Root", env["DOCUMENT_ROOT"])
+		w.Header().Set("X-App-Env", env["APP_ENV"])
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Query", r.URL.RawQuery)
+		if r.URL.Path == "/missing.php" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		io.Copy(w, r.Body)
+	}))
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+func TestFastCGI(t *testing.T) {
+	ln := newFastCGIServer(t)
+	u := Upstream{
+		HostName: "php.local",
+		Target:   "tcp://" + ln.Addr().String(),
+		Protocol: protocolFastCGI,
+		FastCGI: FastCGI{
+			Root:   "/var/www/html",
+			Params: map[string]string{"APP_ENV": "test"},
+		},
+	}
+	us, err := newUpstream(NewConfig(WithUpstream(u)), u, nil, slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	proxy := httptest.NewServer(us)
+	defer proxy.Close()
+
+	tests := []struct {
+		name                   string
+		method                 string
+		path                   string
+		body                   string
+		expectedStatus         int
+		expectedScriptFilename string
+		expectedQuery          string
+	}{
+		{
+			name:                   "script",
+			method:                 http.MethodGet,
+			path:                   "/info.php?a=1",
+			expectedStatus:         http.StatusOK,
+			expectedScriptFilename: "/var/www/html/info.php",
+			expectedQuery:          "a=1",
+		},
+		{
+			name:                   "path info",
+			method:                 http.MethodGet,
+			path:                   "/app/index.php/users/1",
+			expectedStatus:         http.StatusOK,
+			expectedScriptFilename: "/var/www/html/app/index.php",
+		},
+		{
+			name:                   "directory index",
+			method:                 http.MethodGet,
+			path:                   "/blog/",
+			expectedStatus:         http.StatusOK,
+			expectedScriptFilename: "/var/www/html/blog/index.php",
+		},
+		{
+			name:                   "front controller",
+			method:                 http.MethodGet,
+			path:                   "/users/1",
+			expectedStatus:         http.StatusOK,
+			expectedScriptFilename: "/var/www/html/index.php",
+		},
+		{
+			name:                   "post body",
+			method:                 http.MethodPost,
+			path:                   "/form.php",
+			body:                   strings.Repeat("gondola", 20000),
+			expectedStatus:         http.StatusOK,
+			expectedScriptFilename: "/var/www/html/form.php",
+		},
+		{
+			name:                   "status",
+			method:                 http.MethodGet,
+			path:                   "/missing.php",
+			expectedStatus:         http.StatusNotFound,
+			expectedScriptFilename: "/var/www/html/missing.php",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, proxy.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = "php.local"
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.StatusCode != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, res.StatusCode)
+			}
+			if v := res.Header.Get("X-Script-Filename"); v != tt.expectedScriptFilename {
+				t.Errorf("Expected SCRIPT_FILENAME %q, got %q", tt.expectedScriptFilename, v)
+			}
+			if v := res.Header.Get("X-Document-Root"); v != "/var/www/html" {
+				t.Errorf("Expected DOCUMENT_ROOT /var/www/html, got %q", v)
+			}
+			if v := res.Header.Get("X-App-Env"); v != "test" {
+				t.Errorf("Expected APP_ENV test, got %q", v)
+			}
+			if v := res.Header.Get("X-Method"); v != tt.method {
+				t.Errorf("Expected method %s, got %s", tt.method, v)
+			}
+			if v := res.Header.Get("X-Query"); v != tt.expectedQuery {
+				t.Errorf("Expected query %q, got %q", tt.expectedQuery, v)
+			}
+			if string(body) != tt.body {
+				t.Errorf("Expected body of %d bytes, got %d bytes", len(tt.body), len(body))
+			}
+		})
+	}
+}
+
+func TestFastCGISplitPath(t *testing.T) {
+	tests := []struct {
+		name               string
+		path               string
+		expectedScriptName string
+		expectedPathInfo   string
+	}{
+		{name: "script", path: "/info.php", expectedScriptName: "/info.php"},
+		{name: "path info", path: "/app/index.php/users/1", expectedScriptName: "/app/index.php", expectedPathInfo: "/users/1"},
+		{name: "extension in directory name", path: "/lib.phpx/test.php", expectedScriptName: "/lib.phpx/test.php"},
+		{name: "upper case extension", path: "/INFO.PHP", expectedScriptName: "/INFO.PHP"},
+		{name: "directory index", path: "/blog/", expectedScriptName: "/blog/index.php"},
+		{name: "root", path: "/", expectedScriptName: "/index.php"},
+		{name: "front controller", path: "/users/1", expectedScriptName: "/index.php"},
+		{name: "dot segments", path: "/../secret.php", expectedScriptName: "/secret.php"},
+	}
+
+	target, err := url.Parse("tcp://127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := newFastCGITransport(FastCGI{}, target, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scriptName, pathInfo := tr.splitPath(tt.path)
+			if scriptName != tt.expectedScriptName {
+				t.Errorf("Expected SCRIPT_NAME %q, got %q", tt.expectedScriptName, scriptName)
+			}
+			if pathInfo != tt.expectedPathInfo {
+				t.Errorf("Expected PATH_INFO %q, got %q", tt.expectedPathInfo, pathInfo)
+			}
+		})
+	}
+}
+
+func TestFastCGIParamsHeaders(t *testing.T) {
+	target, err := url.Parse("tcp://127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := newFastCGITransport(FastCGI{}, target, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/index.php", nil)
+	req.Header.Set("X-Foo-Bar", "dash")
+	req.Header["X-Foo_bar"] = []string{"underscore"}
+	req.Header["X_Only"] = []string{"underscore"}
+	req.Header.Set("Proxy", "http://evil")
+	params := tr.params(req)
+
+	tests := []struct {
+		name     string
+		expected string
+		ok       bool
+	}{
+		{name: "HTTP_X_FOO_BAR", expected: "dash", ok: true},
+		{name: "HTTP_X_ONLY"},
+		{name: "HTTP_PROXY"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, ok := params[tt.name]
+			if ok != tt.ok || v != tt.expected {
+				t.Errorf("Expected %s to be %q (set: %v), got %q (set: %v)", tt.name, tt.expected, tt.ok, v, ok)
+			}
+		})
+	}
+}
+
+func TestNewFastCGITransportError(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+	}{
+		{name: "http target", target: "http://127.0.0.1:9000"},
+		{name: "missing host", target: "tcp://"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := url.Parse(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := newFastCGITransport(FastCGI{}, target, ""); err == nil {
+				t.Error("Expected error but got none")
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package gondola
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultFileDiscoveryInterval = 5 * time.Second
+
+// targetGroup is a group of targets listed in a file of file discovery.
+type targetGroup struct {
+	HostName string   `yaml:"host_name" json:"host_name"`
+	Targets  []string `yaml:"targets" json:"targets"`
+}
+
+// fileDiscoverer finds the targets of an upstream from a file.
+type fileDiscoverer struct {
+	hostName string
+	path     string
+	format   Format
+	every    time.Duration
+}
+
+// newFileDiscoverer validates the file discovery configuration of the upstream with the host name.
+// The file itself is not read, since it may be written after the proxy starts.
+func newFileDiscoverer(hostName string, c FileDiscovery) (*fileDiscoverer, error) {
+	format, err := FormatFromPath(c.Path)
+	if err != nil {
+		return nil, err
+	}
+	if format != FormatJSON && format != FormatYAML {
+		return nil, fmt.Errorf("unsupported file_discovery format: %q", format)
+	}
+	if c.Interval < 0 {
+		return nil, fmt.Errorf("invalid file_discovery interval: %d", c.Interval)
+	}
+	d := &fileDiscoverer{
+		hostName: hostName,
+		path:     filepath.Clean(c.Path),
+		format:   format,
+		every:    time.Duration(c.Interval) * time.Millisecond,
+	}
+	if d.every == 0 {
+		d.every = defaultFileDiscoveryInterval
+	}
+	return d, nil
+}
+
+// interval implements the discoverer interface.
+func (d *fileDiscoverer) interval() time.Duration {
+	return d.every
+}
+
+// targets implements the discoverer interface.
+// An error is returned if the file cannot be parsed or any of its targets is invalid, so that no partial target set is applied.
+func (d *fileDiscoverer) targets(_ context.Context) ([]string, error) {
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return nil, err
+	}
+	var groups []targetGroup
+	switch d.format {
+	case FormatJSON:
+		err = json.Unmarshal(data, &groups)
+	default:
+		err = yaml.Unmarshal(data, &groups)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", d.path, err)
+	}
+
+	var targets []string
+	for _, g := range groups {
+		if g.HostName != "" && g.HostName != d.hostName {
+			continue
+		}
+		for _, t := range g.Targets {
+			if err := validateTarget(t); err != nil {
+				return nil, fmt.Errorf("invalid target %q in %s: %w", t, d.path, err)
+			}
+			targets = append(targets, t)
+		}
+	}
+	slices.Sort(targets)
+	return slices.Compact(targets), nil
+}
+
+// validateTarget checks that the target is a URL with a scheme and a host, or a unix domain socket.
+func validateTarget(target string) error {
+	u, socketPath, err := parseTarget(target)
+	if err != nil {
+		return err
+	}
+	if socketPath == "" && (u.Scheme == "" || u.Host == "") {
+		return errors.New("scheme and host are required")
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package gondola
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNewFileDiscoverer(t *testing.T) {
+	tests := []struct {
+		name           string
+		config         FileDiscovery
+		expectedFormat Format
+		expectedEvery  time.Duration
+		expectedError  bool
+	}{
+		{name: "yaml", config: FileDiscovery{Path: "targets.yml"}, expectedFormat: FormatYAML, expectedEvery: defaultFileDiscoveryInterval},
+		{name: "json", config: FileDiscovery{Path: "targets.json", Interval: 1000}, expectedFormat: FormatJSON, expectedEvery: time.Second},
+		{name: "toml", config: FileDiscovery{Path: "targets.toml"}, expectedError: true},
+		{name: "unknown extension", config: FileDiscovery{Path: "targets.txt"}, expectedError: true},
+		{name: "negative interval", config: FileDiscovery{Path: "targets.json", Interval: -1}, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := newFileDiscoverer("shop.example.com", tt.config)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if actual.format != tt.expectedFormat {
+				t.Errorf("Expected format %s, got %s", tt.expectedFormat, actual.format)
+			}
+			if actual.interval() != tt.expectedEvery {
+				t.Errorf("Expected interval %v, got %v", tt.expectedEvery, actual.interval())
+			}
+		})
+	}
+}
+
+func TestFileDiscovererTargets(t *testing.T) {
+	tests := []struct {
+		name          string
+		file          string
+		content       string
+		expected      []string
+		expectedError bool
+	}{
+		{
+			name: "yaml",
+			file: "targets.yaml",
+			content: `
+- host_name: shop.example.com
+  targets: ["http://10.0.0.33:8080", "http://10.0.0.32:8080"]
+- host_name: api.example.com
+  targets: ["http://10.0.0.40:8080"]
+- targets: ["unix:///run/shop.sock", "http://10.0.0.32:8080"]
+`,
+			expected: []string{"http://10.0.0.32:8080", "http://10.0.0.33:8080", "unix:///run/shop.sock"},
+		},
+		{
+			name:     "json",
+			file:     "targets.json",
+			content:  `[{"host_name": "shop.example.com", "targets": ["http://10.0.0.32:8080"]}]`,
+			expected: []string{"http://10.0.0.32:8080"},
+		},
+		{name: "no group", file: "targets.json", content: `[{"host_name": "api.example.com", "targets": ["http://10.0.0.40:8080"]}]`},
+		{name: "parse error", file: "targets.json", content: `[{"targets": [`, expectedError: true},
+		{name: "target without scheme", file: "targets.yaml", content: `- targets: ["10.0.0.32:8080"]`, expectedError: true},
+		{name: "target without host", file: "targets.yaml", content: `- targets: ["http://"]`, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			d, err := newFileDiscoverer("shop.example.com", FileDiscovery{Path: path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := d.targets(context.Background())
+			if tt.expectedError {
+				if err == nil {
+					t.Errorf("Expected error but got targets %v", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !slices.Equal(actual, tt.expected) {
+				t.Errorf("Expected targets %v, got %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	a := newStatusServer(t, "a", 200)
+	b := newStatusServer(t, "b", 200)
+	path := filepath.Join(t.TempDir(), "targets.json")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// waitFor waits until the pool has n targets, as the file is read again in the background.
+	waitFor := func(p *targetPool, n int) {
+		t.Helper()
+		for range 100 {
+			p.mu.Lock()
+			count := len(p.targets)
+			p.mu.Unlock()
+			if count == n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Expected %d targets", n)
+	}
+
+	write(`[{"targets": ["` + a.URL + `"]}]`)
+	p, err := newTargetPool(Upstream{
+		HostName:      "backend.local",
+		FileDiscovery: FileDiscovery{Path: path, Interval: 10},
+	}, nil, slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.discover(ctx)
+	if names := roundTripNames(t, p, 4); slices.Contains(names, "b") {
+		t.Errorf("Expected only a to be discovered, got %v", names)
+	}
+
+	write(`[{"targets": ["` + a.URL + `", "` + b.URL + `"]}]`)
+	waitFor(p, 2)
+	if names := roundTripNames(t, p, 4); !slices.Contains(names, "a") || !slices.Contains(names, "b") {
+		t.Errorf("Expected a and b to be discovered, got %v", names)
+	}
+
+	write(`[{"targets": ["` + b.URL + `"`)
+	time.Sleep(50 * time.Millisecond)
+	if names := roundTripNames(t, p, 4); !slices.Contains(names, "a") || !slices.Contains(names, "b") {
+		t.Errorf("Expected targets to be kept on a parse error, got %v", names)
+	}
+
+	write(`[{"targets": ["` + b.URL + `"]}]`)
+	waitFor(p, 1)
+	if names := roundTripNames(t, p, 4); slices.Contains(names, "a") {
+		t.Errorf("Expected a to be removed, got %v", names)
+	}
+}
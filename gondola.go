@@ -1,159 +1,265 @@
 package gondola
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
-	"os"
-	"path/filepath"
-	"strings"
 	"time"
 )
 
 // Runner is an interface that defines the Run method.
 type Runner interface {
-	Run() error
+	Run(ctx context.Context) error
 }
 
 // NewGondola returns a new Gondola.
 func NewGondola(r io.Reader) (*Gondola, error) {
+	return NewGondolaWithFormat(r, FormatYAML)
+}
+
+// NewGondolaWithFormat returns a new Gondola from a configuration in the given format.
+func NewGondolaWithFormat(r io.Reader, format Format) (*Gondola, error) {
 	cfg := &Config{}
-	c, err := cfg.Load(r)
+	c, err := cfg.LoadFormat(r, format)
 	if err != nil {
 		return nil, &ConfigLoadError{Err: err}
 	}
+	return NewGondolaFromConfig(c)
+}
+
+// NewGondolaFromConfig returns a new Gondola from a Config built in code.
+func NewGondolaFromConfig(c *Config) (*Gondola, error) {
+	rt, err := newRouter(c)
+	if err != nil {
+		return nil, &ProxyServerError{Err: err}
+	}
+
+	am, err := newACMEManager(c)
+	if err != nil {
+		return nil, &ProxyServerError{Err: err}
+	}
+
+	listeners, err := newListeners(c, rt, am)
+	if err != nil {
+		return nil, &ProxyServerError{Err: err}
+	}
 
-	s, err := NewServer(c)
+	streams, err := newStreamProxies(c)
 	if err != nil {
 		return nil, &ProxyServerError{Err: err}
 	}
 
-	return &Gondola{
-		config: c,
-		server: s,
-	}, nil
+	g := &Gondola{
+		config:    c,
+		listeners: listeners,
+		streams:   streams,
+		router:    rt,
+		acme:      am,
+		reload:    make(chan struct{}, 1),
+	}
+	if g.usesTLS() {
+		if err := validateCertificates(c); err != nil {
+			return nil, &ProxyServerError{Err: err}
+		}
+	}
+	return g, nil
 }
 
 // NewServer creates a new HTTP server with the given configuration.
 func NewServer(c *Config) (*http.Server, error) {
-	mux := http.NewServeMux()
-	logger := NewLogger(c.LogLevel)
+	rt, err := newRouter(c)
+	if err != nil {
+		return nil, err
+	}
+	return newHTTPServer(c, rt), nil
+}
 
-	// Validate upstream configurations first
-	for _, upstream := range c.Upstreams {
-		if _, err := url.Parse(upstream.Target); err != nil {
-			return nil, fmt.Errorf("invalid upstream target URL %s: %w", upstream.Target, err)
-		}
+// newHTTPServer creates a new HTTP server that serves the given handler.
+func newHTTPServer(c *Config, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              ":" + c.Proxy.Port,
+		ReadHeaderTimeout: time.Duration(c.Proxy.ReadHeaderTimeout) * time.Millisecond,
+		Handler:           h,
 	}
+}
 
-	// Create a main handler that will handle both static files and proxy requests
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// First, try to serve static files
-		for _, sf := range c.Proxy.StaticFiles {
-			// Check if the request path starts with the configured path
-			if strings.HasPrefix(r.URL.Path, sf.Path) {
-				p := strings.TrimPrefix(r.URL.Path, sf.Path)
-				r2 := new(http.Request)
-				*r2 = *r
-				r2.URL = new(url.URL)
-				*r2.URL = *r.URL
-				r2.URL.Path = p
-
-				fullPath := filepath.Join(sf.Dir, p)
-				fileInfo, err := os.Stat(fullPath)
-
-				// Always use fallback for directory requests or non-existent files
-				var useFallback bool
-				if err != nil {
-					useFallback = true
-				} else if fileInfo.IsDir() {
-					// If directory and has index.html, serve it
-					indexPath := filepath.Join(fullPath, "index.html")
-					if _, err := os.Stat(indexPath); err == nil {
-						http.ServeFile(w, r2, indexPath)
-						return
-					}
-					useFallback = true
-				}
+// Handler returns the http.Handler that serves static files and proxies requests to upstreams.
+// It can be used to embed gondola in other servers, after calling Start if targets or upstreams are discovered.
+func (g *Gondola) Handler() http.Handler {
+	return g.router
+}
 
-				if useFallback {
-					fallbackFile := "index.html"
-					if sf.FallbackPath != "" {
-						fallbackFile = sf.FallbackPath
-					}
-					http.ServeFile(w, r2, filepath.Join(sf.Dir, fallbackFile))
-					return
-				}
+// Use registers middlewares that are applied to all requests.
+// Middlewares are applied in the order they are registered.
+func (g *Gondola) Use(mws ...Middleware) {
+	g.router.use(mws...)
+}
 
-				// Serve the existing file
-				http.ServeFile(w, r2, fullPath)
-				return
-			}
-		}
+// UseUpstream registers middlewares that are applied to requests for the upstream with the given host name.
+func (g *Gondola) UseUpstream(hostName string, mws ...Middleware) error {
+	return g.router.useUpstream(hostName, mws...)
+}
 
-		// If no static file is matched, try to proxy the request
-		for _, upstream := range c.Upstreams {
-			if r.Host == upstream.HostName {
-				target, err := url.Parse(upstream.Target)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
+// Start starts discovering the targets of upstreams with dns or file_discovery, and the upstreams of docker containers,
+// until the context is cancelled. The first targets are looked up before it returns.
+// Run calls Start, so it is only needed when Handler is served by another server. Only the first call has an effect.
+func (g *Gondola) Start(ctx context.Context) {
+	g.start.Do(func() {
+		g.router.startDiscovery(ctx)
+	})
+}
+
+// ReloadCertificates reloads the static TLS certificates of the running server, e.g. when SIGHUP is received.
+// If the new certificates are invalid, the current ones are kept.
+func (g *Gondola) ReloadCertificates() {
+	select {
+	case g.reload <- struct{}{}:
+	default: // a reload is already pending
+	}
+}
+
+// TODO: Need to dynamically load a configuration file. For now, we will limit the implementation to just loading the file at startup.
+// Run starts the proxy server and blocks until the context is cancelled or the server fails.
+// When the context is cancelled, the server is gracefully shut down within ShutdownTimeout.
+func (g *Gondola) Run(ctx context.Context) error {
+	// Background work such as certificate watching and discovery stops when Run returns.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-				proxy := httputil.NewSingleHostReverseProxy(target)
-				proxy.Transport = NewLogRoundTripper(http.DefaultTransport)
-				proxy.Director = func(req *http.Request) {
-					req.URL.Scheme = target.Scheme
-					req.URL.Host = target.Host
+	logger := NewLogger(g.config.LogLevel)
+	slog.SetDefault(logger.Logger)
+
+	// TODO: do health check for upstreams.
+
+	g.Start(ctx)
+
+	var tlsConfig *tls.Config
+	if g.usesTLS() {
+		c, err := newTLSConfig(ctx, g.config, g.acme, g.reload)
+		if err != nil {
+			return fmt.Errorf("error configuring TLS: %w", err)
+		}
+		tlsConfig = c
+	}
+
+	lns := make([]net.Listener, 0, len(g.listeners))
+	pcs := make([]net.PacketConn, len(g.listeners))
+	// The HTTP/3 server does not close the packet connections it serves.
+	defer func() {
+		for _, pc := range pcs {
+			if pc != nil {
+				pc.Close()
+			}
+		}
+	}()
+	for i, l := range g.listeners {
+		ln, err := l.listen()
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return fmt.Errorf("error listening on %s: %w", l.config.Address, err)
+		}
+		lns = append(lns, ln)
+		if l.http3 != nil {
+			pc, err := l.listenPacket()
+			if err != nil {
+				for _, ln := range lns {
+					ln.Close()
 				}
-				handler := NewProxyHandler(proxy, logger.Logger)
-				handler.ServeHTTP(w, r)
-				return
+				return fmt.Errorf("error listening on %s for HTTP/3: %w", l.config.Address, err)
 			}
+			pcs[i] = pc
 		}
-	})
+	}
+	for i, s := range g.streams {
+		if err := s.listen(); err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			for _, s := range g.streams[:i] {
+				s.close()
+			}
+			return fmt.Errorf("error listening on %s: %w", s.config.Listen, err)
+		}
+	}
 
-	// Handle favicon.ico requests
-	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
-		for _, sf := range c.Proxy.StaticFiles {
-			if _, err := os.Stat(filepath.Join(sf.Dir, "favicon.ico")); err == nil {
-				http.ServeFile(w, r, filepath.Join(sf.Dir, "favicon.ico"))
-				return
+	errCh := make(chan error, 2*len(g.listeners)+len(g.streams))
+	for i, l := range g.listeners {
+		go func(l *listener, ln net.Listener) {
+			if l.config.TLS {
+				slog.Info(fmt.Sprintf("Running server on %s with TLS...", l.config.Address))
+			} else {
+				slog.Info("Running server on " + l.config.Address + "...")
 			}
+			errCh <- l.serve(ln, tlsConfig)
+		}(l, lns[i])
+		if pc := pcs[i]; pc != nil {
+			go func(l *listener, pc net.PacketConn) {
+				slog.Info("Running HTTP/3 server on " + l.config.Address + "...")
+				errCh <- l.serveHTTP3(pc, tlsConfig)
+			}(l, pc)
 		}
-		w.WriteHeader(http.StatusNoContent)
-	})
+	}
+	for _, s := range g.streams {
+		go func(s *streamProxy) {
+			slog.Info(fmt.Sprintf("Running %s stream on %s...", s.network, s.config.Listen))
+			if err := s.serve(tlsConfig); err != nil {
+				errCh <- err
+			}
+		}(s)
+	}
 
-	server := &http.Server{
-		Addr:              ":" + c.Proxy.Port,
-		ReadHeaderTimeout: time.Duration(c.Proxy.ReadHeaderTimeout) * time.Millisecond,
-		Handler:           mux,
+	var runErr error
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, http.ErrServerClosed) {
+			runErr = fmt.Errorf("error running server: %w", err)
+		}
+	case <-ctx.Done():
 	}
 
-	return server, nil
+	shutdownCtx := context.Background()
+	if g.config.Proxy.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		shutdownCtx, cancel = context.WithTimeout(shutdownCtx, time.Duration(g.config.Proxy.ShutdownTimeout)*time.Millisecond)
+		defer cancel()
+	}
+	slog.Info("Shutting down server...")
+	for _, l := range g.listeners {
+		if err := l.server.Shutdown(shutdownCtx); err != nil && runErr == nil {
+			runErr = fmt.Errorf("error shutting down server: %w", err)
+		}
+		if l.http3 != nil {
+			if err := l.http3.Shutdown(shutdownCtx); err != nil && runErr == nil {
+				runErr = fmt.Errorf("error shutting down HTTP/3 server: %w", err)
+			}
+		}
+	}
+	for _, s := range g.streams {
+		if err := s.shutdown(shutdownCtx); err != nil && runErr == nil {
+			runErr = fmt.Errorf("error shutting down stream %s: %w", s.config.Listen, err)
+		}
+	}
+	return runErr
 }
 
-// TODO: Need to dynamically load a configuration file. For now, we will limit the implementation to just loading the file at startup.
-// Run starts the proxy server.
-func (g *Gondola) Run() error {
-	logger := NewLogger(g.config.LogLevel)
-	slog.SetDefault(logger.Logger)
-
-	// TODO: do health check for upstreams.
-
-	if g.config.Proxy.IsEnableTLS() {
-		slog.Info(fmt.Sprintf("Running server on port %s with TLS...", g.config.Proxy.Port))
-		if err := g.server.ListenAndServeTLS(g.config.Proxy.TLSCertPath, g.config.Proxy.TLSKeyPath); err != nil {
-			slog.Error("Error running server with TLS: " + err.Error())
+// usesTLS returns true if any listener or stream terminates TLS.
+func (g *Gondola) usesTLS() bool {
+	for _, l := range g.listeners {
+		if l.config.TLS {
+			return true
 		}
-	} else {
-		slog.Info("Running server on port " + g.config.Proxy.Port + "...")
-		if err := g.server.ListenAndServe(); err != nil {
-			slog.Error("Error running server: " + err.Error())
+	}
+	for _, s := range g.streams {
+		if s.config.TLS {
+			return true
 		}
 	}
-	return nil
+	return false
 }
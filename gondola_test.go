@@ -1,16 +1,36 @@
 package gondola
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
+// waitForServer waits until the server accepts connections on the given address.
+func waitForServer(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server on %s did not start", addr)
+}
+
 func TestNewGondola(t *testing.T) {
 	data := `
 proxy:
@@ -36,10 +56,37 @@ log_level: -4
 	if gondola.config == nil {
 		t.Errorf("Expected config, got nil")
 	}
-	if gondola.server == nil {
-		t.Errorf("Expected server, got nil")
+	if len(gondola.listeners) != 1 {
+		t.Errorf("Expected 1 listener, got %d", len(gondola.listeners))
+	}
+}
+
+func TestNewGondolaFromConfig(t *testing.T) {
+	c := NewConfig(
+		WithPort("8080"),
+		WithUpstream(Upstream{HostName: "backend1.local", Target: "http://backend1:8081"}),
+	)
+	gondola, err := NewGondolaFromConfig(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if gondola.config != c {
+		t.Errorf("Expected config %v, got %v", c, gondola.config)
+	}
+	if len(gondola.listeners) != 1 {
+		t.Errorf("Expected 1 listener, got %d", len(gondola.listeners))
+	}
+}
+
+func TestNewGondolaWithFormat(t *testing.T) {
+	data := `{"proxy": {"port": "8080"}, "upstreams": [{"host_name": "backend1.local", "target": "http://backend1:8081"}]}`
+	gondola, err := NewGondolaWithFormat(strings.NewReader(data), FormatJSON)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if gondola.config.Proxy.Port != "8080" {
+		t.Errorf("Expected port 8080, got %s", gondola.config.Proxy.Port)
 	}
-	gondola.server.Close()
 }
 
 func TestNewGondolaConfigLoadError(t *testing.T) {
@@ -82,6 +129,27 @@ log_level: -4
 	}
 }
 
+func TestNewGondolaUncoveredHost(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeCertificate(t, dir, "backend1", time.Now().Add(time.Hour), "backend1.local")
+	c := NewConfig(
+		WithListener(Listener{Address: ":8443", TLS: true}),
+		WithUpstream(Upstream{HostName: "backend1.local", Target: "http://backend1:8081", TLSCertPath: certPath, TLSKeyPath: keyPath}),
+		WithUpstream(Upstream{HostName: "backend2.local", Target: "http://backend2:8082"}),
+	)
+	_, err := NewGondolaFromConfig(c)
+	var psErr *ProxyServerError
+	if !errors.As(err, &psErr) || !strings.Contains(err.Error(), "backend2.local") {
+		t.Errorf("Expected error for the uncovered host, got %v", err)
+	}
+
+	// Hosts without a static certificate are covered by ACME.
+	c.Proxy.ACME = ACME{Enabled: true, CacheDir: t.TempDir()}
+	if _, err := NewGondolaFromConfig(c); err != nil {
+		t.Errorf("Expected no error with ACME, got %v", err)
+	}
+}
+
 func TestRunWithoutTLS(t *testing.T) {
 	backend1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("backend1"))
@@ -124,9 +192,12 @@ log_level: -4
 		t.Fatalf("Expected no error, got %v", err)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
 	go func() {
-		gondola.Run()
+		done <- gondola.Run(ctx)
 	}()
+	waitForServer(t, "localhost:8080")
 
 	for _, test := range []struct {
 		name    string
@@ -182,7 +253,10 @@ log_level: -4
 			}
 		})
 	}
-	gondola.server.Close()
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
 }
 
 func TestRunWithTLS(t *testing.T) {
@@ -229,9 +303,12 @@ log_level: -4
 		t.Fatalf("Expected no error, got %v", err)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
 	go func() {
-		gondola.Run()
+		done <- gondola.Run(ctx)
 	}()
+	waitForServer(t, "localhost:5443")
 
 	for _, test := range []struct {
 		name    string
@@ -292,5 +369,249 @@ log_level: -4
 			}
 		})
 	}
-	gondola.server.Close()
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestRunWithMultipleListeners(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+
+	gondola, err := NewGondolaFromConfig(NewConfig(
+		WithTLS("testdata/certificates/cert.pem", "testdata/certificates/key.pem"),
+		WithListener(Listener{Address: "127.0.0.1:18080", RedirectToHTTPS: true}),
+		WithListener(Listener{Address: "127.0.0.1:18081"}),
+		WithListener(Listener{Address: "127.0.0.1:18443", TLS: true}),
+		WithUpstream(Upstream{HostName: "backend.local", Target: backend.URL}),
+	))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- gondola.Run(ctx)
+	}()
+	waitForServer(t, "127.0.0.1:18080")
+	waitForServer(t, "127.0.0.1:18081")
+	waitForServer(t, "127.0.0.1:18443")
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	for _, test := range []struct {
+		name     string
+		reqPath  string
+		code     int
+		body     string
+		location string
+	}{
+		{
+			name:     "redirect plain listener",
+			reqPath:  "http://127.0.0.1:18080/foo?bar=baz",
+			code:     http.StatusPermanentRedirect,
+			location: "https://backend.local:18443/foo?bar=baz",
+		},
+		{
+			name:    "plain listener",
+			reqPath: "http://127.0.0.1:18081/",
+			code:    http.StatusOK,
+			body:    "backend",
+		},
+		{
+			name:    "tls listener",
+			reqPath: "https://127.0.0.1:18443/",
+			code:    http.StatusOK,
+			body:    "backend",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, test.reqPath, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = "backend.local"
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != test.code {
+				t.Errorf("Expected status code %d, got %d", test.code, res.StatusCode)
+			}
+			if test.body != "" && string(b) != test.body {
+				t.Errorf("Expected body %s, got %s", test.body, string(b))
+			}
+			if loc := res.Header.Get("Location"); loc != test.location {
+				t.Errorf("Expected location %s, got %s", test.location, loc)
+			}
+		})
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestRunContextCancel(t *testing.T) {
+	gondola, err := NewGondolaFromConfig(NewConfig(WithPort("0"), WithShutdownTimeout(1000)))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- gondola.Run(ctx)
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Run to return after context cancel")
+	}
+}
+
+func TestHandlerWithMiddleware(t *testing.T) {
+	backend1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend1:" + r.Header.Get("X-Global") + ":" + r.Header.Get("X-Upstream")))
+	}))
+	defer backend1.Close()
+
+	backend2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend2:" + r.Header.Get("X-Global") + ":" + r.Header.Get("X-Upstream")))
+	}))
+	defer backend2.Close()
+
+	gondola, err := NewGondolaFromConfig(NewConfig(
+		WithUpstream(Upstream{HostName: "backend1.local", Target: backend1.URL}),
+		WithUpstream(Upstream{HostName: "backend2.local", Target: backend2.URL}),
+	))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var order []string
+	header := func(name, value string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				r.Header.Set(name, value)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	gondola.Use(header("X-Global", "first"), header("X-Global", "second"))
+	if err := gondola.UseUpstream("backend1.local", header("X-Upstream", "upstream")); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := gondola.UseUpstream("unknown.local", header("X-Upstream", "upstream")); err == nil {
+		t.Error("Expected error for unknown upstream, got nil")
+	}
+
+	ts := httptest.NewServer(gondola.Handler())
+	defer ts.Close()
+
+	for _, test := range []struct {
+		host  string
+		body  string
+		order []string
+	}{
+		{
+			host:  "backend1.local",
+			body:  "backend1:second:upstream",
+			order: []string{"X-Global", "X-Global", "X-Upstream"},
+		},
+		{
+			host:  "backend2.local",
+			body:  "backend2:second:",
+			order: []string{"X-Global", "X-Global"},
+		},
+	} {
+		t.Run(test.host, func(t *testing.T) {
+			order = nil
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = test.host
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != test.body {
+				t.Errorf("Expected body %s, got %s", test.body, string(b))
+			}
+			if strings.Join(order, ",") != strings.Join(test.order, ",") {
+				t.Errorf("Expected middleware order %v, got %v", test.order, order)
+			}
+		})
+	}
+}
+
+func TestHandlerWithDiscovery(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("discovered"))
+	}))
+	defer backend.Close()
+	path := filepath.Join(t.TempDir(), "targets.json")
+	if err := os.WriteFile(path, []byte(`[{"targets": ["`+backend.URL+`"]}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	gondola, err := NewGondolaFromConfig(NewConfig(
+		WithUpstream(Upstream{HostName: "backend1.local", FileDiscovery: FileDiscovery{Path: path}}),
+	))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	gondola.Start(ctx)
+	gondola.Start(ctx)
+
+	ts := httptest.NewServer(gondola.Handler())
+	defer ts.Close()
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "backend1.local"
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || string(b) != "discovered" {
+		t.Errorf("Expected the discovered target to respond, got %d %s", res.StatusCode, b)
+	}
 }
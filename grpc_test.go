@@ -0,0 +1,188 @@
+package gondola
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+// writeGRPCMessage writes a length-prefixed gRPC message.
+func writeGRPCMessage(w io.Writer, msg []byte) error {
+	prefix := make([]byte, 5)
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	if _, err := w.Write(append(prefix, msg...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readGRPCMessage reads a length-prefixed gRPC message.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// newGRPCEchoServer starts an h2c server that implements a bidirectional streaming gRPC echo method.
+// A "fail" message ends the stream with the INVALID_ARGUMENT status.
+func newGRPCEchoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" {
+			http.Error(w, "gRPC over HTTP/2 is required", http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		for {
+			msg, err := readGRPCMessage(r.Body)
+			if err != nil {
+				w.Header().Set("Grpc-Status", "0")
+				return
+			}
+			if string(msg) == "fail" {
+				w.Header().Set("Grpc-Status", "3")
+				w.Header().Set("Grpc-Message", "invalid%20argument")
+				return
+			}
+			if err := writeGRPCMessage(w, msg); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}))
+	s.Config.Protocols = new(http.Protocols)
+	s.Config.Protocols.SetUnencryptedHTTP2(true)
+	s.Start()
+	return s
+}
+
+func TestGRPCOverH2C(t *testing.T) {
+	backend := newGRPCEchoServer(t)
+	defer backend.Close()
+
+	c := NewConfig(
+		WithListener(Listener{Address: "127.0.0.1:18082", H2C: true}),
+		WithUpstream(Upstream{HostName: "grpc.local", Target: backend.URL, Protocol: protocolH2C}),
+	)
+	gondola, err := NewGondolaFromConfig(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- gondola.Run(ctx)
+	}()
+	waitForServer(t, "127.0.0.1:18082")
+
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: tr}
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:18082/echo.Echo/Stream", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "grpc.local"
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2, got %s", res.Proto)
+	}
+
+	// Each message is echoed before the next one is sent, which requires streaming in both directions.
+	for _, msg := range []string{"hello", "world"} {
+		if err := writeGRPCMessage(pw, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readGRPCMessage(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != msg {
+			t.Errorf("Expected message %s, got %s", msg, got)
+		}
+	}
+	pw.Close()
+
+	if _, err := io.ReadAll(res.Body); err != nil {
+		t.Fatal(err)
+	}
+	if status := res.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("Expected grpc-status trailer 0, got %q", status)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestProxyHandlerGRPCLog(t *testing.T) {
+	backend := newGRPCEchoServer(t)
+	defer backend.Close()
+
+	target, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, err := newTransport(Upstream{Protocol: protocolH2C}, target, "", slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = NewLogRoundTripper(transport)
+
+	var buf bytes.Buffer
+	handler := NewProxyHandler(proxy, slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	var body bytes.Buffer
+	if err := writeGRPCMessage(&body, []byte("fail")); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/echo.Echo/Stream", &body)
+	req.Header.Set("Content-Type", "application/grpc")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if status := rec.Result().Trailer.Get("Grpc-Status"); status != "3" {
+		t.Errorf("Expected grpc-status trailer 3, got %q", status)
+	}
+
+	var log map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &log); err != nil {
+		t.Fatalf("Failed to parse access log: %v", err)
+	}
+	if log["grpc_status"] != "3" {
+		t.Errorf("Expected grpc_status 3, got %v", log["grpc_status"])
+	}
+	if log["grpc_message"] != "invalid argument" {
+		t.Errorf("Expected grpc_message invalid argument, got %v", log["grpc_message"])
+	}
+}
@@ -0,0 +1,30 @@
+package gondola
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// withAltSvc returns a handler that advertises HTTP/3 via the Alt-Svc header.
+// The header is omitted until the HTTP/3 server is listening.
+func withAltSvc(next http.Handler, h3 *http3.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = h3.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listenPacket announces on the UDP port of the listener address for HTTP/3.
+func (l *listener) listenPacket() (net.PacketConn, error) {
+	return net.ListenPacket("udp", l.config.Address)
+}
+
+// serveHTTP3 accepts QUIC connections on pc until the server is shut down.
+// The TLS configuration is shared with the TLS listener, so certificates and client authentication are the same.
+func (l *listener) serveHTTP3(pc net.PacketConn, tlsConfig *tls.Config) error {
+	l.http3.TLSConfig = tlsConfig
+	return l.http3.Serve(pc)
+}
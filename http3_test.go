@@ -0,0 +1,95 @@
+package gondola
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestRunWithHTTP3(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeCertificate(t, dir, "server", time.Now().Add(time.Hour), "h3.local")
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+
+	c := NewConfig(
+		WithTLS(certPath, keyPath),
+		WithListener(Listener{Address: "127.0.0.1:18447", TLS: true, HTTP3: true}),
+		WithUpstream(Upstream{HostName: "h3.local", Target: backend.URL}),
+	)
+	gondola, err := NewGondolaFromConfig(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- gondola.Run(ctx)
+	}()
+	waitForServer(t, "127.0.0.1:18447")
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true, ServerName: "h3.local"}
+
+	// HTTP/3 is advertised on responses over TCP.
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	var altSvc string
+	deadline := time.Now().Add(2 * time.Second)
+	for altSvc == "" && time.Now().Before(deadline) {
+		req, err := http.NewRequest(http.MethodGet, "https://127.0.0.1:18447/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "h3.local"
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		altSvc = res.Header.Get("Alt-Svc")
+		if altSvc == "" {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if !strings.Contains(altSvc, `h3=":18447"`) {
+		t.Errorf("Expected Alt-Svc to advertise h3 on port 18447, got %q", altSvc)
+	}
+
+	tr := &http3.Transport{TLSClientConfig: tlsConfig}
+	defer tr.Close()
+	req, err := http.NewRequest(http.MethodGet, "https://127.0.0.1:18447/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "h3.local"
+	res, err := (&http.Client{Transport: tr, Timeout: 5 * time.Second}).Do(req)
+	if err != nil {
+		t.Fatalf("Expected HTTP/3 request to succeed, got %v", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ProtoMajor != 3 {
+		t.Errorf("Expected HTTP/3, got %s", res.Proto)
+	}
+	if string(body) != "backend" {
+		t.Errorf("Expected body backend, got %s", body)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
@@ -0,0 +1,629 @@
+package gondola
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// streamDialTimeout is the timeout to connect to a stream target.
+	streamDialTimeout = 10 * time.Second
+	// streamHandshakeTimeout is the timeout to read the ClientHello or complete the TLS handshake of a stream connection.
+	streamHandshakeTimeout = 10 * time.Second
+	// defaultUDPIdleTimeout is the default idle timeout of UDP sessions.
+	defaultUDPIdleTimeout = 60 * time.Second
+	// maxDatagramSize is the maximum size of a UDP datagram.
+	maxDatagramSize = 64 * 1024
+	// defaultUDPMaxSessions is the default maximum number of UDP sessions of a stream.
+	defaultUDPMaxSessions = 10000
+	// maxPendingDatagrams is the maximum number of datagrams kept for a UDP session while its target is being connected.
+	maxPendingDatagrams = 16
+)
+
+// errClientHelloRead is returned to abort a handshake once the ClientHello has been read.
+var errClientHelloRead = errors.New("client hello read")
+
+// streamTargets is a set of target addresses that connections are distributed to in round robin order.
+type streamTargets struct {
+	addrs []string
+	next  atomic.Uint64
+}
+
+// dial connects to the next target, trying the other targets if it fails.
+func (t *streamTargets) dial(ctx context.Context, network string) (net.Conn, error) {
+	start := t.next.Add(1) - 1
+	d := net.Dialer{Timeout: streamDialTimeout}
+	var err error
+	for i := range t.addrs {
+		addr := t.addrs[(start+uint64(i))%uint64(len(t.addrs))]
+		conn, dialErr := d.DialContext(ctx, network, addr)
+		if dialErr == nil {
+			return conn, nil
+		}
+		err = dialErr
+	}
+	return nil, err
+}
+
+// streamProxy is a layer 4 proxy that forwards raw TCP connections or UDP datagrams to targets.
+type streamProxy struct {
+	config      Stream
+	network     string
+	targets     *streamTargets
+	routes      map[string]*streamTargets
+	idleTimeout time.Duration
+	maxSessions int
+	tlsConfig   *tls.Config
+
+	ln     net.Listener
+	pc     net.PacketConn
+	closed atomic.Bool
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	conns  map[io.Closer]struct{}
+}
+
+// newStreamProxies validates the stream configurations and creates the stream proxies.
+func newStreamProxies(c *Config) ([]*streamProxy, error) {
+	proxies := make([]*streamProxy, 0, len(c.Streams))
+	for _, st := range c.Streams {
+		s, err := newStreamProxy(c, st)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stream %s: %w", st.Listen, err)
+		}
+		proxies = append(proxies, s)
+	}
+	return proxies, nil
+}
+
+// newStreamProxy creates a stream proxy from the given configuration.
+func newStreamProxy(c *Config, st Stream) (*streamProxy, error) {
+	if _, _, err := net.SplitHostPort(st.Listen); err != nil {
+		return nil, fmt.Errorf("invalid listen address: %w", err)
+	}
+
+	s := &streamProxy{
+		config:      st,
+		network:     st.Protocol,
+		routes:      make(map[string]*streamTargets),
+		idleTimeout: time.Duration(st.IdleTimeout) * time.Millisecond,
+		maxSessions: st.MaxSessions,
+		conns:       make(map[io.Closer]struct{}),
+	}
+	switch st.Protocol {
+	case "", "tcp":
+		s.network = "tcp"
+		if st.MaxSessions != 0 {
+			return nil, errors.New("max_sessions is only available for udp")
+		}
+	case "udp":
+		if st.TLS || len(st.Routes) > 0 {
+			return nil, errors.New("tls and routes are only available for tcp")
+		}
+		if s.idleTimeout == 0 {
+			s.idleTimeout = defaultUDPIdleTimeout
+		}
+		if s.maxSessions == 0 {
+			s.maxSessions = defaultUDPMaxSessions
+		}
+	default:
+		return nil, fmt.Errorf("unsupported protocol: %s", st.Protocol)
+	}
+	if st.IdleTimeout < 0 {
+		return nil, fmt.Errorf("invalid idle_timeout: %d", st.IdleTimeout)
+	}
+	if st.MaxSessions < 0 {
+		return nil, fmt.Errorf("invalid max_sessions: %d", st.MaxSessions)
+	}
+	if st.TLS && !isEnableTLS(c) {
+		return nil, errors.New("stream uses TLS but no certificate is configured")
+	}
+
+	if len(st.Targets) == 0 && len(st.Routes) == 0 {
+		return nil, errors.New("no targets are configured")
+	}
+	if len(st.Targets) > 0 {
+		t, err := newStreamTargets(st.Targets)
+		if err != nil {
+			return nil, err
+		}
+		s.targets = t
+	}
+	for _, r := range st.Routes {
+		if r.ServerName == "" {
+			return nil, errors.New("route server_name must not be empty")
+		}
+		t, err := newStreamTargets(r.Targets)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %s: %w", r.ServerName, err)
+		}
+		s.routes[strings.ToLower(r.ServerName)] = t
+	}
+
+	return s, nil
+}
+
+// newStreamTargets validates the target addresses and creates a target set.
+func newStreamTargets(addrs []string) (*streamTargets, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no targets are configured")
+	}
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid target %s: %w", addr, err)
+		}
+	}
+	return &streamTargets{addrs: addrs}, nil
+}
+
+// listen announces on the stream address.
+func (s *streamProxy) listen() error {
+	if s.network == "udp" {
+		pc, err := net.ListenPacket("udp", s.config.Listen)
+		if err != nil {
+			return err
+		}
+		s.pc = pc
+		return nil
+	}
+	ln, err := net.Listen("tcp", s.config.Listen)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	return nil
+}
+
+// close stops listening.
+func (s *streamProxy) close() {
+	s.closed.Store(true)
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	if s.pc != nil {
+		s.pc.Close()
+	}
+}
+
+// serve forwards connections or datagrams until the stream proxy is shut down.
+// TLS is terminated with the given TLS configuration if the stream uses TLS.
+func (s *streamProxy) serve(tlsConfig *tls.Config) error {
+	if s.config.TLS {
+		s.tlsConfig = streamTLSConfig(tlsConfig)
+	}
+	if s.network == "udp" {
+		return s.serveUDP()
+	}
+	return s.serveTCP()
+}
+
+// shutdown stops accepting connections and waits for active connections to finish.
+// Connections still active when the context is done are closed.
+func (s *streamProxy) shutdown(ctx context.Context) error {
+	s.close()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for c := range s.conns {
+			c.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// track registers a connection to be closed if the drain times out.
+func (s *streamProxy) track(c io.Closer) {
+	s.mu.Lock()
+	s.conns[c] = struct{}{}
+	s.mu.Unlock()
+}
+
+// untrack removes a connection registered by track.
+func (s *streamProxy) untrack(c io.Closer) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+}
+
+// streamTLSConfig returns the TLS configuration of TLS listeners without HTTP application protocols.
+func streamTLSConfig(tlsConfig *tls.Config) *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := tlsConfig
+			if tlsConfig.GetConfigForClient != nil {
+				c, err := tlsConfig.GetConfigForClient(hello)
+				if err != nil {
+					return nil, err
+				}
+				cfg = c
+			}
+			cfg = cfg.Clone()
+			cfg.NextProtos = nil
+			return cfg, nil
+		},
+	}
+}
+
+func (s *streamProxy) serveTCP() error {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if s.closed.Load() {
+				return nil
+			}
+			return err
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleTCP(conn)
+		}()
+	}
+}
+
+// handleTCP forwards a TCP connection to a target and logs it when it closes.
+func (s *streamProxy) handleTCP(conn net.Conn) {
+	start := time.Now()
+	s.track(conn)
+	defer s.untrack(conn)
+	defer conn.Close()
+
+	attrs := []any{
+		slog.String("listen", s.config.Listen),
+		slog.String("protocol", s.network),
+		slog.String("remote_addr", conn.RemoteAddr().String()),
+	}
+
+	client := conn
+	serverName := ""
+	if s.tlsConfig != nil {
+		tc := tls.Server(conn, s.tlsConfig)
+		ctx, cancel := context.WithTimeout(context.Background(), streamHandshakeTimeout)
+		err := tc.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			slog.Warn("stream TLS handshake failed: "+err.Error(), attrs...)
+			return
+		}
+		serverName = tc.ConnectionState().ServerName
+		client = tc
+	} else if len(s.routes) > 0 {
+		name, c, err := peekServerName(conn)
+		if err != nil {
+			slog.Warn("error reading stream ClientHello: "+err.Error(), attrs...)
+			return
+		}
+		serverName = name
+		client = c
+	}
+	attrs = append(attrs, slog.String("server_name", serverName))
+
+	targets := s.targets
+	if t, ok := s.routes[strings.ToLower(serverName)]; ok {
+		targets = t
+	}
+	if targets == nil {
+		slog.Warn("no stream route matches server name", attrs...)
+		return
+	}
+
+	upstream, err := targets.dial(context.Background(), "tcp")
+	if err != nil {
+		slog.Error("error connecting to stream target: "+err.Error(), attrs...)
+		return
+	}
+	s.track(upstream)
+	defer s.untrack(upstream)
+	defer upstream.Close()
+
+	received, sent := s.pipe(client, upstream)
+
+	slog.Info("stream_connection", append(attrs,
+		slog.String("target", upstream.RemoteAddr().String()),
+		slog.Float64("duration", time.Since(start).Seconds()),
+		slog.Int64("bytes_received", received),
+		slog.Int64("bytes_sent", sent),
+	)...)
+}
+
+// pipe copies data between the client and the upstream until both directions are done,
+// and returns the bytes received from the client and sent to the client.
+// Traffic in either direction extends the idle timeout of both connections.
+func (s *streamProxy) pipe(client, upstream net.Conn) (int64, int64) {
+	extend := func() {}
+	if s.idleTimeout > 0 {
+		extend = func() {
+			deadline := time.Now().Add(s.idleTimeout)
+			_ = client.SetDeadline(deadline)
+			_ = upstream.SetDeadline(deadline)
+		}
+		extend()
+	}
+
+	var received, sent int64
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		received = copyConn(upstream, client, extend)
+	}()
+	go func() {
+		defer wg.Done()
+		sent = copyConn(client, upstream, extend)
+	}()
+	wg.Wait()
+	return received, sent
+}
+
+// closeWriter is a connection that can be half closed.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// copyConn copies from src to dst until src is done, and half closes dst so that the other direction can finish.
+// If the copy fails, both connections are closed.
+func copyConn(dst, src net.Conn, extend func()) int64 {
+	buf := make([]byte, 32*1024)
+	var total int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			extend()
+			written, werr := dst.Write(buf[:n])
+			total += int64(written)
+			if werr != nil {
+				src.Close()
+				return total
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			if cw, ok := dst.(closeWriter); ok {
+				_ = cw.CloseWrite()
+			} else {
+				dst.Close()
+			}
+			return total
+		}
+		if err != nil {
+			dst.Close()
+			src.Close()
+			return total
+		}
+	}
+}
+
+// peekServerName reads the SNI server name from the ClientHello without consuming it,
+// and returns a connection that replays the ClientHello so that TLS can be passed through.
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(streamHandshakeTimeout)); err != nil {
+		return "", nil, err
+	}
+	var buf bytes.Buffer
+	var serverName string
+	err := tls.Server(readOnlyConn{r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errClientHelloRead) {
+		return "", nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return "", nil, err
+	}
+	return serverName, &prefixConn{Conn: conn, r: io.MultiReader(&buf, conn)}, nil
+}
+
+// readOnlyConn is a net.Conn that only reads, used to parse a ClientHello without answering it.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// prefixConn is a net.Conn that reads already consumed bytes before the rest of the connection.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// CloseWrite half closes the underlying connection.
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// udpSession is the association of a UDP client with a target.
+type udpSession struct {
+	client     net.Addr
+	upstream   net.Conn // nil while the target is being connected, guarded by the sessions lock
+	pending    [][]byte // datagrams received while the target is being connected, guarded by the sessions lock
+	start      time.Time
+	lastActive atomic.Int64
+	received   atomic.Int64
+	sent       atomic.Int64
+}
+
+func (s *streamProxy) serveUDP() error {
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+	full := false // whether datagrams of new clients are dropped, guarded by mu
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			if s.closed.Load() {
+				mu.Lock()
+				for _, sess := range sessions {
+					if sess.upstream != nil {
+						sess.upstream.Close()
+					}
+				}
+				mu.Unlock()
+				return nil
+			}
+			return err
+		}
+
+		key := addr.String()
+		mu.Lock()
+		sess, ok := sessions[key]
+		switch {
+		case ok && sess.upstream == nil:
+			if len(sess.pending) < maxPendingDatagrams {
+				sess.pending = append(sess.pending, slices.Clone(buf[:n]))
+			}
+		case ok:
+			// Datagrams are written under the lock so that a session is not removed between its activity and the write.
+			sess.lastActive.Store(time.Now().UnixNano())
+			if _, err := sess.upstream.Write(buf[:n]); err == nil {
+				sess.received.Add(int64(n))
+			}
+		case len(sessions) >= s.maxSessions:
+			if !full {
+				full = true
+				slog.Warn("stream_sessions_exceeded",
+					slog.String("listen", s.config.Listen),
+					slog.String("protocol", s.network),
+					slog.Int("max_sessions", s.maxSessions),
+				)
+			}
+		default:
+			sess = &udpSession{client: addr, pending: [][]byte{slices.Clone(buf[:n])}, start: time.Now()}
+			sess.lastActive.Store(sess.start.UnixNano())
+			sessions[key] = sess
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				remove := func(idleOnly bool) bool {
+					mu.Lock()
+					defer mu.Unlock()
+					if idleOnly && time.Since(time.Unix(0, sess.lastActive.Load())) < s.idleTimeout {
+						return false
+					}
+					delete(sessions, key)
+					full = false
+					return true
+				}
+				if !s.connectUDP(sess, &mu) {
+					remove(false)
+					return
+				}
+				s.replyUDP(sess, remove)
+			}()
+		}
+		mu.Unlock()
+	}
+}
+
+// connectUDP connects the session to a target without holding the sessions lock mu, so that resolving and connecting
+// do not delay the datagrams of other clients, and forwards the datagrams received meanwhile.
+// It returns false if no target can be connected or the stream is closed.
+func (s *streamProxy) connectUDP(sess *udpSession, mu *sync.Mutex) bool {
+	upstream, err := s.targets.dial(context.Background(), "udp")
+	if err != nil {
+		slog.Error("error connecting to stream target: "+err.Error(),
+			slog.String("listen", s.config.Listen),
+			slog.String("protocol", s.network),
+			slog.String("remote_addr", sess.client.String()),
+		)
+		return false
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if s.closed.Load() {
+		upstream.Close()
+		return false
+	}
+	sess.upstream = upstream
+	s.track(upstream)
+	for _, d := range sess.pending {
+		if _, err := upstream.Write(d); err == nil {
+			sess.received.Add(int64(len(d)))
+		}
+	}
+	sess.pending = nil
+	sess.lastActive.Store(time.Now().UnixNano())
+	return true
+}
+
+// replyUDP forwards datagrams from the target to the client until the session is idle, and logs the session.
+// remove removes the session so that no more datagrams are written to it, only if it is idle when idleOnly is true,
+// and reports whether it was removed. The session is removed before its target connection is closed.
+func (s *streamProxy) replyUDP(sess *udpSession, remove func(idleOnly bool) bool) {
+	defer s.untrack(sess.upstream)
+	defer sess.upstream.Close()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		last := time.Unix(0, sess.lastActive.Load())
+		if err := sess.upstream.SetReadDeadline(last.Add(s.idleTimeout)); err != nil {
+			break
+		}
+		n, err := sess.upstream.Read(buf)
+		if n > 0 {
+			sess.lastActive.Store(time.Now().UnixNano())
+			if written, err := s.pc.WriteTo(buf[:n], sess.client); err == nil {
+				sess.sent.Add(int64(written))
+			}
+		}
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				if !remove(true) {
+					continue // the client sent a datagram after the deadline was set
+				}
+				break
+			}
+			remove(false)
+			break
+		}
+	}
+
+	slog.Info("stream_connection",
+		slog.String("listen", s.config.Listen),
+		slog.String("protocol", s.network),
+		slog.String("remote_addr", sess.client.String()),
+		slog.String("target", sess.upstream.RemoteAddr().String()),
+		slog.Float64("duration", time.Since(sess.start).Seconds()),
+		slog.Int64("bytes_received", sess.received.Load()),
+		slog.Int64("bytes_sent", sess.sent.Load()),
+	)
+}
@@ -0,0 +1,461 @@
+package gondola
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTCPServer starts a TCP server that handles each connection with handle.
+func startTCPServer(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// echo copies everything it reads back to the connection.
+func echo(conn net.Conn) {
+	io.Copy(conn, conn)
+}
+
+// replyName returns a handler that writes name and closes the connection.
+func replyName(name string) func(net.Conn) {
+	return func(conn net.Conn) {
+		conn.Write([]byte(name))
+	}
+}
+
+// runGondola runs gondola with the given configuration until the test ends.
+func runGondola(t *testing.T, c *Config, addr string) (context.CancelFunc, <-chan error) {
+	t.Helper()
+	g, err := NewGondolaFromConfig(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- g.Run(ctx)
+	}()
+	t.Cleanup(cancel)
+	waitForServer(t, addr)
+	return cancel, done
+}
+
+func TestTCPStream(t *testing.T) {
+	echoAddr := startTCPServer(t, echo)
+	cancel, done := runGondola(t, NewConfig(
+		WithListener(Listener{Address: "127.0.0.1:18500"}),
+		WithStream(Stream{Listen: "127.0.0.1:18501", Targets: []string{echoAddr}}),
+	), "127.0.0.1:18501")
+
+	conn, err := net.Dial("tcp", "127.0.0.1:18501")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	// Half closing the connection lets the target finish the other direction.
+	conn.(*net.TCPConn).CloseWrite()
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("Expected hello, got %s", b)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestTCPStreamRoundRobin(t *testing.T) {
+	a := startTCPServer(t, replyName("a"))
+	b := startTCPServer(t, replyName("b"))
+	runGondola(t, NewConfig(
+		WithListener(Listener{Address: "127.0.0.1:18502"}),
+		WithStream(Stream{Listen: "127.0.0.1:18503", Targets: []string{a, b}}),
+	), "127.0.0.1:18502") // streams listen before listeners serve, and no connection must be made to the stream
+
+	var got []string
+	for range 4 {
+		conn, err := net.Dial("tcp", "127.0.0.1:18503")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(b))
+	}
+	if o := strings.Join(got, ""); o != "abab" {
+		t.Errorf("Expected targets in round robin order abab, got %s", o)
+	}
+}
+
+func TestTCPStreamSNIRouting(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeCertificate(t, dir, "server", time.Now().Add(time.Hour), "a.local", "b.local", "c.local")
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// TLS targets for passthrough, which see the ClientHello of the client.
+	tlsServer := func(name string) string {
+		return startTCPServer(t, func(conn net.Conn) {
+			tc := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			tc.Write([]byte(name + ":" + tc.ConnectionState().ServerName))
+		})
+	}
+
+	tests := []struct {
+		name       string
+		stream     Stream
+		serverName string
+		expected   string
+	}{
+		{
+			name: "termination",
+			stream: Stream{
+				Listen:  "127.0.0.1:18504",
+				TLS:     true,
+				Targets: []string{startTCPServer(t, replyName("default"))},
+				Routes: []StreamRoute{
+					{ServerName: "a.local", Targets: []string{startTCPServer(t, replyName("a"))}},
+					{ServerName: "B.local", Targets: []string{startTCPServer(t, replyName("b"))}},
+				},
+			},
+		},
+		{
+			name: "passthrough",
+			stream: Stream{
+				Listen:  "127.0.0.1:18505",
+				Targets: []string{tlsServer("default")},
+				Routes: []StreamRoute{
+					{ServerName: "a.local", Targets: []string{tlsServer("a")}},
+					{ServerName: "b.local", Targets: []string{tlsServer("b")}},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runGondola(t, NewConfig(
+				WithTLS(certPath, keyPath),
+				WithListener(Listener{Address: strings.Replace(tt.stream.Listen, "185", "186", 1)}),
+				WithStream(tt.stream),
+			), tt.stream.Listen)
+
+			for serverName, expected := range map[string]string{"a.local": "a", "b.local": "b", "c.local": "default"} {
+				conn, err := tls.Dial("tcp", tt.stream.Listen, &tls.Config{InsecureSkipVerify: true, ServerName: serverName})
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(conn)
+				conn.Close()
+				if err != nil && !errors.Is(err, io.EOF) {
+					t.Fatal(err)
+				}
+				if tt.name == "passthrough" {
+					expected += ":" + serverName
+				}
+				if string(b) != expected {
+					t.Errorf("Expected %s for %s, got %s", expected, serverName, b)
+				}
+			}
+		})
+	}
+}
+
+func TestTCPStreamIdleTimeout(t *testing.T) {
+	echoAddr := startTCPServer(t, echo)
+	runGondola(t, NewConfig(
+		WithListener(Listener{Address: "127.0.0.1:18506"}),
+		WithStream(Stream{Listen: "127.0.0.1:18507", Targets: []string{echoAddr}, IdleTimeout: 200}),
+	), "127.0.0.1:18507")
+
+	conn, err := net.Dial("tcp", "127.0.0.1:18507")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Traffic keeps the connection open beyond the idle timeout.
+	r := bufio.NewReader(conn)
+	for range 4 {
+		conn.Write([]byte("x"))
+		if _, err := r.ReadByte(); err != nil {
+			t.Fatalf("Expected connection to stay open while active, got %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(2 * time.Second))
+	if _, err := r.ReadByte(); err == nil {
+		t.Fatal("Expected connection to be closed")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected connection to be closed after the idle timeout, took %s", elapsed)
+	}
+}
+
+func TestTCPStreamDrain(t *testing.T) {
+	echoAddr := startTCPServer(t, echo)
+	c := NewConfig(
+		WithListener(Listener{Address: "127.0.0.1:18508"}),
+		WithShutdownTimeout(300),
+		WithStream(Stream{Listen: "127.0.0.1:18509", Targets: []string{echoAddr}}),
+	)
+	cancel, done := runGondola(t, c, "127.0.0.1:18509")
+
+	conn, err := net.Dial("tcp", "127.0.0.1:18509")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("x"))
+	if _, err := r.ReadByte(); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+
+	// Active connections keep working while draining, but new connections are refused.
+	conn.Write([]byte("y"))
+	if b, err := r.ReadByte(); err != nil || b != 'y' {
+		t.Errorf("Expected active connection to work while draining, got %q, %v", b, err)
+	}
+	if c, err := net.Dial("tcp", "127.0.0.1:18509"); err == nil {
+		c.Close()
+		t.Error("Expected new connections to be refused while draining")
+	}
+
+	if err := <-done; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected drain to time out, got %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := r.ReadByte(); err == nil {
+		t.Error("Expected connection to be closed after the drain timed out")
+	}
+}
+
+func TestUDPStream(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo([]byte(strings.ToUpper(string(buf[:n]))), addr)
+		}
+	}()
+
+	cancel, done := runGondola(t, NewConfig(
+		WithListener(Listener{Address: "127.0.0.1:18510"}),
+		WithStream(Stream{Listen: "127.0.0.1:18511", Protocol: "udp", Targets: []string{pc.LocalAddr().String()}, IdleTimeout: 200}),
+	), "127.0.0.1:18510")
+
+	conn, err := net.Dial("udp", "127.0.0.1:18511")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1024)
+	for _, msg := range []string{"query", "again"} {
+		conn.Write([]byte(msg))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != strings.ToUpper(msg) {
+			t.Errorf("Expected %s, got %s", strings.ToUpper(msg), buf[:n])
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestUDPStreamMaxSessions(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	cancel, done := runGondola(t, NewConfig(
+		WithListener(Listener{Address: "127.0.0.1:18514"}),
+		WithStream(Stream{Listen: "127.0.0.1:18515", Protocol: "udp", Targets: []string{pc.LocalAddr().String()}, IdleTimeout: 200, MaxSessions: 1}),
+	), "127.0.0.1:18514")
+
+	dial := func() net.Conn {
+		t.Helper()
+		conn, err := net.Dial("udp", "127.0.0.1:18515")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	// echo sends a datagram and reports whether it was answered within timeout.
+	echo := func(conn net.Conn, timeout time.Duration) bool {
+		t.Helper()
+		conn.Write([]byte("query"))
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		return err == nil && string(buf[:n]) == "query"
+	}
+
+	first, second := dial(), dial()
+	if !echo(first, 2*time.Second) {
+		t.Fatal("Expected the first client to get a reply")
+	}
+	if echo(second, 100*time.Millisecond) {
+		t.Error("Expected datagrams of a client beyond max_sessions to be dropped")
+	}
+	// Once the session of the first client expires, the second client gets a session.
+	time.Sleep(300 * time.Millisecond)
+	if !echo(second, 2*time.Second) {
+		t.Error("Expected the second client to get a reply after the first session expired")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestUDPStreamIdleTimeout(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	cancel, done := runGondola(t, NewConfig(
+		WithListener(Listener{Address: "127.0.0.1:18512"}),
+		WithStream(Stream{Listen: "127.0.0.1:18513", Protocol: "udp", Targets: []string{pc.LocalAddr().String()}, IdleTimeout: 20}),
+	), "127.0.0.1:18512")
+
+	// Each client starts a new session whose first datagram must be answered,
+	// and a datagram sent after the session expired starts another one.
+	buf := make([]byte, 1024)
+	for i := range 20 {
+		conn, err := net.Dial("udp", "127.0.0.1:18513")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range []string{"first", "expired"} {
+			if msg == "expired" {
+				time.Sleep(50 * time.Millisecond)
+			}
+			conn.Write([]byte(msg))
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("Expected reply to %s datagram of client %d, got %v", msg, i, err)
+			}
+			if string(buf[:n]) != msg {
+				t.Errorf("Expected %s, got %s", msg, buf[:n])
+			}
+		}
+		conn.Close()
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestNewStreamProxyError(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *Config
+	}{
+		{name: "invalid listen address", config: NewConfig(WithStream(Stream{Listen: "5432", Targets: []string{"db:5432"}}))},
+		{name: "no targets", config: NewConfig(WithStream(Stream{Listen: ":5432"}))},
+		{name: "invalid target", config: NewConfig(WithStream(Stream{Listen: ":5432", Targets: []string{"db"}}))},
+		{name: "unsupported protocol", config: NewConfig(WithStream(Stream{Listen: ":5432", Protocol: "sctp", Targets: []string{"db:5432"}}))},
+		{name: "udp with tls", config: NewConfig(WithTLS("cert", "key"), WithStream(Stream{Listen: ":53", Protocol: "udp", TLS: true, Targets: []string{"dns:53"}}))},
+		{name: "tls without certificate", config: NewConfig(WithStream(Stream{Listen: ":5432", TLS: true, Targets: []string{"db:5432"}}))},
+		{name: "negative idle timeout", config: NewConfig(WithStream(Stream{Listen: ":5432", Targets: []string{"db:5432"}, IdleTimeout: -1}))},
+		{name: "negative max sessions", config: NewConfig(WithStream(Stream{Listen: ":53", Protocol: "udp", Targets: []string{"dns:53"}, MaxSessions: -1}))},
+		{name: "max sessions with tcp", config: NewConfig(WithStream(Stream{Listen: ":5432", Targets: []string{"db:5432"}, MaxSessions: 10}))},
+		{name: "route without server name", config: NewConfig(WithStream(Stream{Listen: ":443", Routes: []StreamRoute{{Targets: []string{"a:443"}}}}))},
+		{name: "route without targets", config: NewConfig(WithStream(Stream{Listen: ":443", Routes: []StreamRoute{{ServerName: "a.local"}}}))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newStreamProxies(tt.config); err == nil {
+				t.Error("Expected error but got none")
+			}
+		})
+	}
+}
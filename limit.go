@@ -0,0 +1,179 @@
+package gondola
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueueTimeout = time.Second
+
+	// adaptiveLimitTolerance is the ratio of the long-term response time that the short-term one may reach before the limit decreases.
+	adaptiveLimitTolerance = 1.5
+	// adaptiveLimitWindow is the number of samples the long-term response time is averaged over.
+	adaptiveLimitWindow = 600
+	// adaptiveLimitSmoothing is how quickly the limit moves towards a new estimate.
+	adaptiveLimitSmoothing = 0.2
+)
+
+// errConcurrencyLimit is returned when a request exceeds the concurrency limit and its queue.
+var errConcurrencyLimit = errors.New("concurrency limit of upstream exceeded")
+
+// concurrencyLimiter limits the in-flight requests to an upstream, queueing requests beyond the limit in FIFO order.
+type concurrencyLimiter struct {
+	queueSize    int
+	queueTimeout time.Duration
+	adaptive     *adaptiveLimit
+
+	mu       sync.Mutex
+	limit    int
+	inflight int
+	queue    []chan struct{}
+}
+
+// newConcurrencyLimiter validates the concurrency limit configuration and returns nil if it is disabled.
+func newConcurrencyLimiter(c ConcurrencyLimit) (*concurrencyLimiter, error) {
+	if c.MaxRequests < 0 || c.MinRequests < 0 || c.QueueSize < 0 || c.QueueTimeout < 0 {
+		return nil, errors.New("values must not be negative")
+	}
+	if c.MaxRequests == 0 {
+		if c.Adaptive || c.QueueSize > 0 {
+			return nil, errors.New("max_requests must be set to use adaptive or queue_size")
+		}
+		return nil, nil
+	}
+
+	l := &concurrencyLimiter{
+		queueSize:    c.QueueSize,
+		queueTimeout: time.Duration(c.QueueTimeout) * time.Millisecond,
+		limit:        c.MaxRequests,
+	}
+	if l.queueTimeout == 0 {
+		l.queueTimeout = defaultQueueTimeout
+	}
+	if c.Adaptive {
+		minRequests := max(c.MinRequests, 1)
+		if minRequests > c.MaxRequests {
+			return nil, errors.New("min_requests must not be greater than max_requests")
+		}
+		l.adaptive = &adaptiveLimit{min: float64(minRequests), max: float64(c.MaxRequests), limit: float64(c.MaxRequests)}
+	}
+	return l, nil
+}
+
+// acquire waits for an in-flight slot, and returns errConcurrencyLimit if the queue is full or the queue timeout expires.
+func (l *concurrencyLimiter) acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if l.inflight < l.limit && len(l.queue) == 0 {
+		l.inflight++
+		l.mu.Unlock()
+		return nil
+	}
+	if len(l.queue) >= l.queueSize {
+		l.mu.Unlock()
+		return errConcurrencyLimit
+	}
+	ready := make(chan struct{})
+	l.queue = append(l.queue, ready)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+		err = errConcurrencyLimit
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if i := slices.Index(l.queue, ready); i >= 0 {
+		l.queue = slices.Delete(l.queue, i, i+1)
+		return err
+	}
+	// The slot was handed over while giving up.
+	if ctx.Err() != nil {
+		l.releaseLocked()
+		return err
+	}
+	return nil
+}
+
+// release frees an in-flight slot. If rtt is positive, it is used as a sample of the upstream response time for the adaptive limit.
+func (l *concurrencyLimiter) release(rtt time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if a := l.adaptive; a != nil && rtt > 0 {
+		a.update(rtt.Seconds(), l.inflight)
+		l.limit = int(a.limit)
+	}
+	l.releaseLocked()
+}
+
+// releaseLocked frees an in-flight slot and hands free slots to queued requests. The caller must hold l.mu.
+func (l *concurrencyLimiter) releaseLocked() {
+	l.inflight--
+	for len(l.queue) > 0 && l.inflight < l.limit {
+		close(l.queue[0])
+		l.queue = l.queue[1:]
+		l.inflight++
+	}
+}
+
+// adaptiveLimit estimates the concurrency limit from the response time of the upstream.
+// The limit shrinks when responses get slower than the long-term average, and grows while they do not.
+type adaptiveLimit struct {
+	min     float64
+	max     float64
+	limit   float64
+	longRTT float64
+	samples int
+}
+
+// update adjusts the limit with a response time sample taken with inflight requests in flight.
+func (a *adaptiveLimit) update(rtt float64, inflight int) {
+	a.samples++
+	a.longRTT += (rtt - a.longRTT) / float64(min(a.samples, adaptiveLimitWindow))
+
+	// The limit is not grown while it is far from being reached.
+	gradient := max(0.5, min(1, adaptiveLimitTolerance*a.longRTT/rtt))
+	if gradient == 1 && float64(inflight) < a.limit/2 {
+		return
+	}
+	estimate := a.limit*gradient + math.Sqrt(a.limit)
+	a.limit = a.limit*(1-adaptiveLimitSmoothing) + estimate*adaptiveLimitSmoothing
+	a.limit = max(a.min, min(a.max, a.limit))
+}
+
+// limitedBody releases the in-flight slot of a response when its body is closed.
+type limitedBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *limitedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// holdUntilClosed keeps the in-flight slot of the response until its body is closed.
+// Upgraded connections are not counted, as their body must stay an io.ReadWriteCloser.
+func holdUntilClosed(resp *http.Response, err error, release func()) {
+	if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		release()
+		return
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, release: release}
+}
@@ -0,0 +1,185 @@
+package gondola
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewConcurrencyLimiter(t *testing.T) {
+	tests := []struct {
+		name             string
+		config           ConcurrencyLimit
+		expectedDisabled bool
+		expectedAdaptive bool
+		expectedError    bool
+	}{
+		{name: "disabled", config: ConcurrencyLimit{}, expectedDisabled: true},
+		{name: "static", config: ConcurrencyLimit{MaxRequests: 10, QueueSize: 5}},
+		{name: "adaptive", config: ConcurrencyLimit{MaxRequests: 10, MinRequests: 2, Adaptive: true}, expectedAdaptive: true},
+		{name: "negative", config: ConcurrencyLimit{MaxRequests: -1}, expectedError: true},
+		{name: "queue without max requests", config: ConcurrencyLimit{QueueSize: 5}, expectedError: true},
+		{name: "min requests greater than max requests", config: ConcurrencyLimit{MaxRequests: 2, MinRequests: 5, Adaptive: true}, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := newConcurrencyLimiter(tt.config)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if (actual == nil) != tt.expectedDisabled {
+				t.Fatalf("Expected disabled %v, got %+v", tt.expectedDisabled, actual)
+			}
+			if actual != nil && (actual.adaptive != nil) != tt.expectedAdaptive {
+				t.Errorf("Expected adaptive %v, got %+v", tt.expectedAdaptive, actual.adaptive)
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	l, err := newConcurrencyLimiter(ConcurrencyLimit{MaxRequests: 1, QueueSize: 1, QueueTimeout: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if err := l.acquire(ctx); err != nil {
+		t.Fatalf("Expected the first request to be let through, got %v", err)
+	}
+	queued := make(chan error, 1)
+	go func() {
+		queued <- l.acquire(ctx)
+	}()
+	for {
+		l.mu.Lock()
+		n := len(l.queue)
+		l.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := l.acquire(ctx); !errors.Is(err, errConcurrencyLimit) {
+		t.Errorf("Expected errConcurrencyLimit with a full queue, got %v", err)
+	}
+
+	l.release(0)
+	if err := <-queued; err != nil {
+		t.Errorf("Expected the queued request to be let through, got %v", err)
+	}
+
+	start := time.Now()
+	if err := l.acquire(ctx); !errors.Is(err, errConcurrencyLimit) {
+		t.Errorf("Expected errConcurrencyLimit after the queue timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected the request to wait for the queue timeout, waited %v", elapsed)
+	}
+	l.release(0)
+	if l.inflight != 0 || len(l.queue) != 0 {
+		t.Errorf("Expected no request in flight or queued, got %d and %d", l.inflight, len(l.queue))
+	}
+}
+
+func TestAdaptiveLimit(t *testing.T) {
+	a := &adaptiveLimit{min: 2, max: 100, limit: 100}
+	for range 100 {
+		a.update(0.01, 100)
+	}
+	if a.limit != 100 {
+		t.Errorf("Expected the limit to stay at max with stable response times, got %v", a.limit)
+	}
+	for range 20 {
+		a.update(0.1, int(a.limit))
+	}
+	if a.limit >= 50 {
+		t.Errorf("Expected the limit to decrease when responses slow down, got %v", a.limit)
+	}
+	for range 200 {
+		a.update(0.01, int(a.limit))
+	}
+	if a.limit < 90 {
+		t.Errorf("Expected the limit to recover when responses speed up, got %v", a.limit)
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	do := newUpstreamProxy(t, Upstream{
+		Target:           backend.URL,
+		ConcurrencyLimit: ConcurrencyLimit{MaxRequests: 1},
+	})
+
+	first := make(chan int, 1)
+	go func() {
+		first <- do().StatusCode
+	}()
+	// Wait until the first request is in flight.
+	time.Sleep(100 * time.Millisecond)
+	if status := do().StatusCode; status != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 beyond the concurrency limit, got %d", status)
+	}
+	release <- struct{}{}
+	if status := <-first; status != http.StatusOK {
+		t.Errorf("Expected status 200 for the first request, got %d", status)
+	}
+	go func() { release <- struct{}{} }()
+	if status := do().StatusCode; status != http.StatusOK {
+		t.Errorf("Expected status 200 once the slot is released, got %d", status)
+	}
+}
+
+func TestHandleProxyError(t *testing.T) {
+	prev := slog.Default()
+	defer slog.SetDefault(prev)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name           string
+		ctx            context.Context
+		err            error
+		expectedStatus int
+		expectedLog    bool
+	}{
+		{name: "concurrency limit", ctx: context.Background(), err: errConcurrencyLimit, expectedStatus: http.StatusServiceUnavailable},
+		{name: "cancelled while queued", ctx: cancelled, err: context.Canceled, expectedStatus: statusClientClosedRequest},
+		{name: "cancelled by the upstream", ctx: context.Background(), err: context.Canceled, expectedStatus: http.StatusBadGateway, expectedLog: true},
+		{name: "connection error", ctx: context.Background(), err: errors.New("connection refused"), expectedStatus: http.StatusBadGateway, expectedLog: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs syncBuffer
+			slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+			rec := httptest.NewRecorder()
+			handleProxyError(rec, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(tt.ctx), tt.err)
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, rec.Code)
+			}
+			if logged := strings.Contains(logs.String(), "proxy error"); logged != tt.expectedLog {
+				t.Errorf("Expected proxy error to be logged: %v, got logs %q", tt.expectedLog, logs.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package gondola
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// acmeChallengePath is the path prefix of ACME HTTP-01 challenges, which must not be redirected to HTTPS.
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// listener is an address that the proxy server listens on.
+type listener struct {
+	config Listener
+	server *http.Server
+	http3  *http3.Server
+}
+
+// newListeners creates the listeners of the proxy server that serve the given handler.
+// If am is not nil, plain listeners answer ACME HTTP-01 challenges.
+func newListeners(c *Config, h http.Handler, am *acmeManager) ([]*listener, error) {
+	lcs := c.Proxy.GetListeners()
+
+	httpsPort := ""
+	for _, lc := range lcs {
+		if _, ok := unixSocketPath(lc.Address); lc.TLS && !ok {
+			_, port, err := net.SplitHostPort(lc.Address)
+			if err != nil {
+				return nil, fmt.Errorf("invalid listener address %s: %w", lc.Address, err)
+			}
+			httpsPort = port
+			break
+		}
+	}
+
+	opts, err := parseTLSOptions(c.Proxy.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	listeners := make([]*listener, 0, len(lcs))
+	for _, lc := range lcs {
+		if path, ok := unixSocketPath(lc.Address); ok {
+			if path == "" {
+				return nil, fmt.Errorf("invalid listener address %s: unix socket path must not be empty", lc.Address)
+			}
+			if lc.HTTP3 {
+				return nil, fmt.Errorf("listener %s is a unix socket and cannot serve HTTP/3", lc.Address)
+			}
+			if lc.SocketMode != "" {
+				if _, err := parseSocketMode(lc.SocketMode); err != nil {
+					return nil, fmt.Errorf("invalid listener %s: %w", lc.Address, err)
+				}
+			}
+		} else if _, _, err := net.SplitHostPort(lc.Address); err != nil {
+			return nil, fmt.Errorf("invalid listener address %s: %w", lc.Address, err)
+		}
+		if lc.TLS && !isEnableTLS(c) {
+			return nil, fmt.Errorf("listener %s uses TLS but no certificate is configured", lc.Address)
+		}
+
+		handler := h
+		if lc.RedirectToHTTPS {
+			if lc.TLS {
+				return nil, fmt.Errorf("listener %s uses TLS and cannot redirect to HTTPS", lc.Address)
+			}
+			if httpsPort == "" {
+				return nil, fmt.Errorf("listener %s redirects to HTTPS but no TLS listener is configured", lc.Address)
+			}
+			status := lc.RedirectStatus
+			if status == 0 {
+				status = http.StatusPermanentRedirect
+			}
+			if status != http.StatusMovedPermanently && status != http.StatusPermanentRedirect {
+				return nil, fmt.Errorf("listener %s has invalid redirect status %d, must be 301 or 308", lc.Address, status)
+			}
+			handler = redirectToHTTPS(h, httpsPort, status)
+		}
+		if am != nil && !lc.TLS {
+			handler = am.httpHandler(handler)
+		}
+		if lc.TLS && opts.hsts != "" {
+			handler = withHSTS(handler, opts.hsts)
+		}
+
+		var h3 *http3.Server
+		if lc.HTTP3 {
+			if !lc.TLS {
+				return nil, fmt.Errorf("listener %s does not use TLS and cannot serve HTTP/3", lc.Address)
+			}
+			h3 = &http3.Server{
+				Addr:    lc.Address,
+				Handler: handler,
+			}
+			handler = withAltSvc(handler, h3)
+		}
+
+		server := newHTTPServer(c, handler)
+		server.Addr = lc.Address
+		if lc.H2C {
+			if lc.TLS {
+				return nil, fmt.Errorf("listener %s uses TLS and cannot serve h2c", lc.Address)
+			}
+			server.Protocols = new(http.Protocols)
+			server.Protocols.SetHTTP1(true)
+			server.Protocols.SetUnencryptedHTTP2(true)
+		}
+		listeners = append(listeners, &listener{
+			config: lc,
+			server: server,
+			http3:  h3,
+		})
+	}
+
+	return listeners, nil
+}
+
+// listen announces on the listener address.
+func (l *listener) listen() (net.Listener, error) {
+	if path, ok := unixSocketPath(l.config.Address); ok {
+		return listenUnix(path, l.config.SocketMode)
+	}
+	return net.Listen("tcp", l.config.Address)
+}
+
+// serve accepts connections on ln until the server is shut down.
+// TLS listeners use the given TLS configuration and serve HTTP/2 only if it is advertised via ALPN.
+func (l *listener) serve(ln net.Listener, tlsConfig *tls.Config) error {
+	if l.config.TLS {
+		l.server.TLSConfig = tlsConfig.Clone()
+		if !slices.Contains(tlsConfig.NextProtos, "h2") {
+			l.server.Protocols = new(http.Protocols)
+			l.server.Protocols.SetHTTP1(true)
+		}
+		return l.server.ServeTLS(ln, "", "")
+	}
+	return l.server.Serve(ln)
+}
+
+// redirectToHTTPS returns a handler that redirects requests to HTTPS on the given port.
+// ACME challenge requests are passed to next so that certificates can be issued over plain HTTP.
+func redirectToHTTPS(next http.Handler, port string, status int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "443" {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
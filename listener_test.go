@@ -0,0 +1,208 @@
+package gondola
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewListeners(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        *Config
+		expectedCount int
+		expectedError bool
+	}{
+		{
+			name:          "default listener",
+			config:        NewConfig(WithPort("8080")),
+			expectedCount: 1,
+		},
+		{
+			name: "plain and tls listeners",
+			config: NewConfig(
+				WithTLS("cert", "key"),
+				WithListener(Listener{Address: ":80", RedirectToHTTPS: true, RedirectStatus: http.StatusMovedPermanently}),
+				WithListener(Listener{Address: "[::]:443", TLS: true}),
+			),
+			expectedCount: 2,
+		},
+		{
+			name:          "invalid address",
+			config:        NewConfig(WithListener(Listener{Address: "80"})),
+			expectedError: true,
+		},
+		{
+			name:          "tls listener without certificate",
+			config:        NewConfig(WithListener(Listener{Address: ":443", TLS: true})),
+			expectedError: true,
+		},
+		{
+			name:          "redirect without tls listener",
+			config:        NewConfig(WithListener(Listener{Address: ":80", RedirectToHTTPS: true})),
+			expectedError: true,
+		},
+		{
+			name: "redirect on tls listener",
+			config: NewConfig(
+				WithTLS("cert", "key"),
+				WithListener(Listener{Address: ":443", TLS: true, RedirectToHTTPS: true}),
+			),
+			expectedError: true,
+		},
+		{
+			name: "invalid TLS options",
+			config: &Config{
+				Proxy: Proxy{
+					TLSCertPath: "cert",
+					TLSKeyPath:  "key",
+					TLS:         TLS{MinVersion: "1.4"},
+				},
+			},
+			expectedError: true,
+		},
+		{
+			name:          "h2c listener",
+			config:        NewConfig(WithListener(Listener{Address: ":80", H2C: true})),
+			expectedCount: 1,
+		},
+		{
+			name: "h2c on tls listener",
+			config: NewConfig(
+				WithTLS("cert", "key"),
+				WithListener(Listener{Address: ":443", TLS: true, H2C: true}),
+			),
+			expectedError: true,
+		},
+		{
+			name: "http3 listener",
+			config: NewConfig(
+				WithTLS("cert", "key"),
+				WithListener(Listener{Address: ":443", TLS: true, HTTP3: true}),
+			),
+			expectedCount: 1,
+		},
+		{
+			name:          "http3 on plain listener",
+			config:        NewConfig(WithListener(Listener{Address: ":80", HTTP3: true})),
+			expectedError: true,
+		},
+		{
+			name: "unix socket listener",
+			config: NewConfig(
+				WithTLS("cert", "key"),
+				WithListener(Listener{Address: "unix:///run/gondola.sock", SocketMode: "0660", RedirectToHTTPS: true}),
+				WithListener(Listener{Address: ":443", TLS: true}),
+			),
+			expectedCount: 2,
+		},
+		{
+			name:          "invalid socket mode",
+			config:        NewConfig(WithListener(Listener{Address: "unix:///run/gondola.sock", SocketMode: "rw"})),
+			expectedError: true,
+		},
+		{
+			name: "http3 on unix socket listener",
+			config: NewConfig(
+				WithTLS("cert", "key"),
+				WithListener(Listener{Address: "unix:///run/gondola.sock", TLS: true, HTTP3: true}),
+			),
+			expectedError: true,
+		},
+		{
+			name: "invalid redirect status",
+			config: NewConfig(
+				WithTLS("cert", "key"),
+				WithListener(Listener{Address: ":80", RedirectToHTTPS: true, RedirectStatus: http.StatusFound}),
+				WithListener(Listener{Address: ":443", TLS: true}),
+			),
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listeners, err := newListeners(tt.config, http.NotFoundHandler(), nil)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(listeners) != tt.expectedCount {
+				t.Errorf("Expected %d listeners, got %d", tt.expectedCount, len(listeners))
+			}
+		})
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("next"))
+	})
+
+	tests := []struct {
+		name         string
+		port         string
+		status       int
+		host         string
+		path         string
+		expectedCode int
+		expectedLoc  string
+	}{
+		{
+			name:         "default https port",
+			port:         "443",
+			status:       http.StatusMovedPermanently,
+			host:         "example.com",
+			path:         "/foo?bar=baz",
+			expectedCode: http.StatusMovedPermanently,
+			expectedLoc:  "https://example.com/foo?bar=baz",
+		},
+		{
+			name:         "custom https port",
+			port:         "8443",
+			status:       http.StatusPermanentRedirect,
+			host:         "example.com:8080",
+			path:         "/",
+			expectedCode: http.StatusPermanentRedirect,
+			expectedLoc:  "https://example.com:8443/",
+		},
+		{
+			name:         "ipv6 host",
+			port:         "8443",
+			status:       http.StatusPermanentRedirect,
+			host:         "[::1]:8080",
+			path:         "/",
+			expectedCode: http.StatusPermanentRedirect,
+			expectedLoc:  "https://[::1]:8443/",
+		},
+		{
+			name:         "acme challenge",
+			port:         "443",
+			status:       http.StatusPermanentRedirect,
+			host:         "example.com",
+			path:         "/.well-known/acme-challenge/token",
+			expectedCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://"+tt.host+tt.path, nil)
+			w := httptest.NewRecorder()
+
+			redirectToHTTPS(next, tt.port, tt.status).ServeHTTP(w, req)
+
+			if w.Code != tt.expectedCode {
+				t.Errorf("Expected status %d, got %d", tt.expectedCode, w.Code)
+			}
+			if loc := w.Header().Get("Location"); loc != tt.expectedLoc {
+				t.Errorf("Expected location %q, got %q", tt.expectedLoc, loc)
+			}
+		})
+	}
+}
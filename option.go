@@ -0,0 +1,77 @@
+package gondola
+
+// Option is a functional option for building a Config in code.
+type Option func(*Config)
+
+// NewConfig returns a new Config built from the given options.
+func NewConfig(opts ...Option) *Config {
+	c := &Config{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithPort sets the port that the proxy server will listen on.
+func WithPort(port string) Option {
+	return func(c *Config) {
+		c.Proxy.Port = port
+	}
+}
+
+// WithReadHeaderTimeout sets the read header timeout in milliseconds.
+func WithReadHeaderTimeout(ms int) Option {
+	return func(c *Config) {
+		c.Proxy.ReadHeaderTimeout = ms
+	}
+}
+
+// WithShutdownTimeout sets the shutdown timeout in milliseconds.
+func WithShutdownTimeout(ms int) Option {
+	return func(c *Config) {
+		c.Proxy.ShutdownTimeout = ms
+	}
+}
+
+// WithTLS sets the certificate and key file paths used for TLS.
+func WithTLS(certPath, keyPath string) Option {
+	return func(c *Config) {
+		c.Proxy.TLSCertPath = certPath
+		c.Proxy.TLSKeyPath = keyPath
+	}
+}
+
+// WithListener adds a listener configuration.
+func WithListener(l Listener) Option {
+	return func(c *Config) {
+		c.Proxy.Listeners = append(c.Proxy.Listeners, l)
+	}
+}
+
+// WithStaticFile adds a static file configuration.
+func WithStaticFile(sf StaticFile) Option {
+	return func(c *Config) {
+		c.Proxy.StaticFiles = append(c.Proxy.StaticFiles, sf)
+	}
+}
+
+// WithUpstream adds an upstream configuration.
+func WithUpstream(u Upstream) Option {
+	return func(c *Config) {
+		c.Upstreams = append(c.Upstreams, u)
+	}
+}
+
+// WithStream adds a layer 4 stream configuration.
+func WithStream(st Stream) Option {
+	return func(c *Config) {
+		c.Streams = append(c.Streams, st)
+	}
+}
+
+// WithLogLevel sets the log level. Debug:-4 Info:0 Warn:4 Error:8
+func WithLogLevel(level int) Option {
+	return func(c *Config) {
+		c.LogLevel = level
+	}
+}
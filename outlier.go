@@ -0,0 +1,160 @@
+package gondola
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const (
+	defaultOutlierInterval    = 10 * time.Second
+	defaultBaseEjectionTime   = 30 * time.Second
+	defaultMaxEjectionTime    = 300 * time.Second
+	defaultMaxEjectionPercent = 50
+)
+
+// outlierDetector is the parsed outlier detection configuration of an upstream.
+type outlierDetector struct {
+	consecutiveErrors  int
+	interval           time.Duration
+	baseEjectionTime   time.Duration
+	maxEjectionTime    time.Duration
+	maxEjectionPercent int
+}
+
+// newOutlierDetector validates the outlier detection configuration and returns nil if it is disabled.
+func newOutlierDetector(c OutlierDetection) (*outlierDetector, error) {
+	if c.ConsecutiveErrors < 0 || c.Interval < 0 || c.BaseEjectionTime < 0 || c.MaxEjectionTime < 0 || c.MaxEjectionPercent < 0 {
+		return nil, errors.New("values must not be negative")
+	}
+	if c.MaxEjectionPercent > 100 {
+		return nil, errors.New("max_ejection_percent must not be greater than 100")
+	}
+	if c.ConsecutiveErrors == 0 {
+		return nil, nil
+	}
+
+	od := &outlierDetector{
+		consecutiveErrors:  c.ConsecutiveErrors,
+		interval:           time.Duration(c.Interval) * time.Millisecond,
+		baseEjectionTime:   time.Duration(c.BaseEjectionTime) * time.Millisecond,
+		maxEjectionTime:    time.Duration(c.MaxEjectionTime) * time.Millisecond,
+		maxEjectionPercent: c.MaxEjectionPercent,
+	}
+	if od.interval == 0 {
+		od.interval = defaultOutlierInterval
+	}
+	if od.baseEjectionTime == 0 {
+		od.baseEjectionTime = defaultBaseEjectionTime
+	}
+	if od.maxEjectionTime == 0 {
+		od.maxEjectionTime = max(defaultMaxEjectionTime, od.baseEjectionTime)
+	}
+	if od.maxEjectionPercent == 0 {
+		od.maxEjectionPercent = defaultMaxEjectionPercent
+	}
+	if od.maxEjectionTime < od.baseEjectionTime {
+		return nil, errors.New("max_ejection_time must not be less than base_ejection_time")
+	}
+	return od, nil
+}
+
+// ejectionTime returns how long a target is ejected for its nth ejection, doubling from the base ejection time.
+func (od *outlierDetector) ejectionTime(n int) time.Duration {
+	d := od.baseEjectionTime
+	for i := 1; i < n && d < od.maxEjectionTime; i++ {
+		d *= 2
+	}
+	return min(d, od.maxEjectionTime)
+}
+
+// targetHealth is the passive health state of an upstream target.
+type targetHealth struct {
+	failures     int       // consecutive failures
+	firstFailure time.Time // time of the first of the consecutive failures
+	ejections    int       // ejections in a row, reset once the target stays healthy for max_ejection_time
+	ejected      bool
+	readmitted   time.Time
+	readmitTimer *time.Timer // re-admits the ejected target, stopped when the target is removed
+}
+
+// isTargetFailure returns true if the result of a round trip counts as a failure of the target.
+// Errors caused by the client going away are not the target's fault.
+func isTargetFailure(r *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return r.Context().Err() == nil
+	}
+	return resp.StatusCode >= http.StatusInternalServerError
+}
+
+// detectOutlier records the result of an attempt to the target, and ejects the target after consecutive failures.
+// The caller must hold p.mu.
+func (p *targetPool) detectOutlier(t *upstreamTarget, failed bool, now time.Time) {
+	od := p.outlier
+	if od == nil {
+		return
+	}
+	h := &t.health
+	if !failed {
+		h.failures = 0
+		return
+	}
+	if h.ejected {
+		return
+	}
+	if h.failures == 0 || now.Sub(h.firstFailure) > od.interval {
+		h.failures = 0
+		h.firstFailure = now
+	}
+	h.failures++
+	if h.failures < od.consecutiveErrors || !p.canEject() {
+		return
+	}
+
+	if h.ejections > 0 && now.Sub(h.readmitted) > od.maxEjectionTime {
+		h.ejections = 0
+	}
+	h.ejections++
+	h.ejected = true
+	d := od.ejectionTime(h.ejections)
+	slog.Warn("target_ejected",
+		slog.String("host_name", p.hostName),
+		slog.String("target", t.name),
+		slog.Int("consecutive_errors", h.failures),
+		slog.Float64("ejection_time", d.Seconds()),
+		slog.Int("ejections", h.ejections),
+	)
+	h.failures = 0
+	h.readmitTimer = time.AfterFunc(d, func() { p.readmit(t) })
+}
+
+// canEject returns true if one more target can be ejected without exceeding max_ejection_percent or emptying the pool.
+func (p *targetPool) canEject() bool {
+	ejected := 0
+	for _, t := range p.targets {
+		if t.health.ejected {
+			ejected++
+		}
+	}
+	n := len(p.targets)
+	return ejected+1 < n && (ejected+1)*100 <= p.outlier.maxEjectionPercent*n
+}
+
+// readmit returns an ejected target to the pool, unless it has been removed from the pool meanwhile.
+func (p *targetPool) readmit(t *upstreamTarget) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !slices.Contains(p.targets, t) {
+		return
+	}
+	now := time.Now()
+	t.health.ejected = false
+	t.health.readmitted = now
+	p.warmUp(t, now)
+	slog.Info("target_readmitted",
+		slog.String("host_name", p.hostName),
+		slog.String("target", t.name),
+	)
+}
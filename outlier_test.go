@@ -0,0 +1,219 @@
+package gondola
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewOutlierDetector(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        OutlierDetection
+		expected      *outlierDetector
+		expectedError bool
+	}{
+		{name: "disabled", config: OutlierDetection{}},
+		{
+			name:   "defaults",
+			config: OutlierDetection{ConsecutiveErrors: 5},
+			expected: &outlierDetector{
+				consecutiveErrors:  5,
+				interval:           defaultOutlierInterval,
+				baseEjectionTime:   defaultBaseEjectionTime,
+				maxEjectionTime:    defaultMaxEjectionTime,
+				maxEjectionPercent: defaultMaxEjectionPercent,
+			},
+		},
+		{
+			name:   "custom",
+			config: OutlierDetection{ConsecutiveErrors: 3, Interval: 1000, BaseEjectionTime: 2000, MaxEjectionTime: 8000, MaxEjectionPercent: 100},
+			expected: &outlierDetector{
+				consecutiveErrors:  3,
+				interval:           time.Second,
+				baseEjectionTime:   2 * time.Second,
+				maxEjectionTime:    8 * time.Second,
+				maxEjectionPercent: 100,
+			},
+		},
+		{name: "negative", config: OutlierDetection{ConsecutiveErrors: -1}, expectedError: true},
+		{name: "max ejection percent over 100", config: OutlierDetection{ConsecutiveErrors: 5, MaxEjectionPercent: 101}, expectedError: true},
+		{name: "max ejection time less than base", config: OutlierDetection{ConsecutiveErrors: 5, BaseEjectionTime: 2000, MaxEjectionTime: 1000}, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := newOutlierDetector(tt.config)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tt.expected == nil {
+				if actual != nil {
+					t.Errorf("Expected outlier detection to be disabled, got %+v", actual)
+				}
+				return
+			}
+			if *actual != *tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestEjectionTime(t *testing.T) {
+	od := &outlierDetector{baseEjectionTime: time.Second, maxEjectionTime: 5 * time.Second}
+	for n, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 100: 5 * time.Second} {
+		if actual := od.ejectionTime(n); actual != expected {
+			t.Errorf("Expected ejection time %v for ejection %d, got %v", expected, n, actual)
+		}
+	}
+}
+
+// newStatusServer starts a backend that responds with the given status and its name.
+func newStatusServer(t *testing.T, name string, status int) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(name))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// roundTripNames sends n requests through the pool and returns the names of the backends that responded.
+func roundTripNames(t *testing.T, p *targetPool, n int) []string {
+	t.Helper()
+	names := make([]string, 0, n)
+	for range n {
+		req := httptest.NewRequest(http.MethodGet, "http://backend.local/", nil)
+		res, err := p.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		names = append(names, string(body))
+	}
+	return names
+}
+
+func TestOutlierDetection(t *testing.T) {
+	var logs syncBuffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	defer slog.SetDefault(prev)
+
+	healthy := newStatusServer(t, "healthy", http.StatusOK)
+	failing := newStatusServer(t, "failing", http.StatusInternalServerError)
+
+	p, err := newTargetPool(Upstream{
+		HostName:         "backend.local",
+		Target:           healthy.URL,
+		Targets:          []string{failing.URL},
+		OutlierDetection: OutlierDetection{ConsecutiveErrors: 2, BaseEjectionTime: 200},
+	}, nil, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Round robin sends every other request to the failing target until it is ejected.
+	roundTripNames(t, p, 4)
+	if !strings.Contains(logs.String(), `"msg":"target_ejected"`) {
+		t.Fatalf("Expected target_ejected log, got %s", logs.String())
+	}
+	for _, name := range roundTripNames(t, p, 4) {
+		if name != "healthy" {
+			t.Errorf("Expected ejected target to receive no requests, got %s", name)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(logs.String(), `"msg":"target_readmitted"`) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected target to be re-admitted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if names := roundTripNames(t, p, 2); !(names[0] == "failing" || names[1] == "failing") {
+		t.Errorf("Expected re-admitted target to receive requests, got %v", names)
+	}
+
+	// The next ejection of the same target is twice as long.
+	roundTripNames(t, p, 4)
+	if !strings.Contains(logs.String(), `"ejection_time":0.4`) {
+		t.Errorf("Expected ejection time to double, got %s", logs.String())
+	}
+}
+
+func TestOutlierDetectionMaxEjectionPercent(t *testing.T) {
+	var logs syncBuffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	defer slog.SetDefault(prev)
+
+	tests := []struct {
+		name            string
+		targets         []string
+		percent         int
+		expectedEjected int
+	}{
+		{
+			name:            "single target",
+			targets:         []string{newStatusServer(t, "failing", http.StatusBadGateway).URL},
+			percent:         100,
+			expectedEjected: 0,
+		},
+		{
+			name: "whole pool",
+			targets: []string{
+				newStatusServer(t, "failing1", http.StatusBadGateway).URL,
+				newStatusServer(t, "failing2", http.StatusBadGateway).URL,
+			},
+			percent:         100,
+			expectedEjected: 1,
+		},
+		{
+			name: "percent",
+			targets: []string{
+				newStatusServer(t, "failing1", http.StatusBadGateway).URL,
+				newStatusServer(t, "failing2", http.StatusBadGateway).URL,
+				newStatusServer(t, "failing3", http.StatusBadGateway).URL,
+			},
+			percent:         33,
+			expectedEjected: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newTargetPool(Upstream{
+				HostName:         "backend.local",
+				Targets:          tt.targets,
+				OutlierDetection: OutlierDetection{ConsecutiveErrors: 1, MaxEjectionPercent: tt.percent},
+			}, nil, slog.Default())
+			if err != nil {
+				t.Fatal(err)
+			}
+			roundTripNames(t, p, 10)
+			ejected := 0
+			for _, target := range p.targets {
+				if target.health.ejected {
+					ejected++
+				}
+			}
+			if ejected != tt.expectedEjected {
+				t.Errorf("Expected %d ejected targets, got %d", tt.expectedEjected, ejected)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package gondola
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// upstreamTarget is one of the targets that requests for an upstream are balanced across.
+type upstreamTarget struct {
+	name      string // the target as configured
+	url       *url.URL
+	addr      string // logged as upstream_addr
+	transport http.RoundTripper
+	health    targetHealth  // guarded by targetPool.mu
+	circuit   targetCircuit // guarded by targetPool.mu
+
+	// warmingSince is when the slow start of the target began, or zero if it receives its full share. Guarded by targetPool.mu.
+	warmingSince time.Time
+}
+
+// targetPool is a http.RoundTripper that balances requests across the targets of an upstream.
+type targetPool struct {
+	config   Upstream
+	logger   *slog.Logger
+	hostName string
+	outlier  *outlierDetector
+	retry    *retryPolicy
+	budget   *retryBudget
+	breaker  *circuitBreaker
+	limiter  *concurrencyLimiter
+	affinity *affinity
+
+	// slowStart is the duration over which the share of a target that joined or recovered ramps up.
+	slowStart time.Duration
+	// discoverer finds the targets of the pool, or is nil if they are static.
+	discoverer discoverer
+
+	mu      sync.Mutex
+	targets []*upstreamTarget
+	next    int
+}
+
+// newTargetPool creates a pool of the targets of the upstream, each with its own transport.
+// Retries are limited by budget, which is shared by all upstreams, or unlimited if budget is nil.
+func newTargetPool(u Upstream, budget *retryBudget, logger *slog.Logger) (*targetPool, error) {
+	od, err := newOutlierDetector(u.OutlierDetection)
+	if err != nil {
+		return nil, fmt.Errorf("invalid outlier_detection of upstream %s: %w", u.HostName, err)
+	}
+	rp, err := newRetryPolicy(u.Retry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retry of upstream %s: %w", u.HostName, err)
+	}
+	cb, err := newCircuitBreaker(u.CircuitBreaker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid circuit_breaker of upstream %s: %w", u.HostName, err)
+	}
+	cl, err := newConcurrencyLimiter(u.ConcurrencyLimit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid concurrency_limit of upstream %s: %w", u.HostName, err)
+	}
+	af, err := newAffinity(u.Affinity)
+	if err != nil {
+		return nil, fmt.Errorf("invalid affinity of upstream %s: %w", u.HostName, err)
+	}
+	if u.SlowStart < 0 {
+		return nil, fmt.Errorf("invalid slow_start of upstream %s: %d", u.HostName, u.SlowStart)
+	}
+
+	p := &targetPool{
+		config:    u,
+		logger:    logger,
+		hostName:  u.HostName,
+		outlier:   od,
+		retry:     rp,
+		budget:    budget,
+		breaker:   cb,
+		limiter:   cl,
+		affinity:  af,
+		slowStart: time.Duration(u.SlowStart) * time.Millisecond,
+	}
+	for _, name := range upstreamTargets(u) {
+		t, err := p.newTarget(name)
+		if err != nil {
+			return nil, err
+		}
+		p.targets = append(p.targets, t)
+	}
+	if af != nil {
+		af.build(p.targets)
+	}
+
+	d, err := newDiscoverer(u)
+	if err != nil {
+		return nil, fmt.Errorf("invalid discovery of upstream %s: %w", u.HostName, err)
+	}
+	p.discoverer = d
+	return p, nil
+}
+
+// newTarget creates a target of the pool with its own transport.
+func (p *targetPool) newTarget(name string) (*upstreamTarget, error) {
+	target, socketPath, err := parseTarget(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream target URL %s: %w", name, err)
+	}
+	transport, err := newTransport(p.config, target, socketPath, p.logger)
+	if err != nil {
+		return nil, err
+	}
+	addr := target.Host
+	if socketPath != "" {
+		addr = name
+	}
+	return &upstreamTarget{name: name, url: target, addr: addr, transport: transport}, nil
+}
+
+// closeTargets releases targets that are no longer used by the pool: their pending re-admission is stopped
+// and the idle connections of their transports are closed. Requests in flight to them are not interrupted.
+func (p *targetPool) closeTargets(targets []*upstreamTarget) {
+	p.mu.Lock()
+	for _, t := range targets {
+		if t.health.readmitTimer != nil {
+			t.health.readmitTimer.Stop()
+		}
+	}
+	p.mu.Unlock()
+	for _, t := range targets {
+		// The default transport is shared by upstreams, and its idle connections expire on their own.
+		if c, ok := t.transport.(interface{ CloseIdleConnections() }); ok && t.transport != http.DefaultTransport {
+			c.CloseIdleConnections()
+		}
+	}
+}
+
+// close releases all targets of a pool that is no longer used.
+func (p *targetPool) close() {
+	p.mu.Lock()
+	targets := p.targets
+	p.mu.Unlock()
+	p.closeTargets(targets)
+}
+
+// upstreamTargets returns Target followed by Targets of the upstream, or nothing if its targets are discovered.
+func upstreamTargets(u Upstream) []string {
+	if isDiscovered(u) {
+		return nil
+	}
+	if u.Target == "" && len(u.Targets) > 0 {
+		return u.Targets
+	}
+	return append([]string{u.Target}, u.Targets...)
+}
+
+// pick returns the target the request has affinity with, or the next target in round robin order, preferring targets not tried yet.
+// Targets whose circuit is open are skipped, and ejected targets are only picked if no other target is available.
+// Warming targets are skipped at random during their slow start, including by affinity.
+// An error is returned if the circuits of all targets are open.
+func (p *targetPool) pick(r *http.Request, tried []*upstreamTarget) (*upstreamTarget, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.targets) == 0 {
+		return nil, errNoTargets
+	}
+	now := time.Now()
+	if p.affinity != nil {
+		usable := func(t *upstreamTarget) bool {
+			return p.circuitAllows(t, now) && !t.health.ejected && !slices.Contains(tried, t) && !p.skipWarming(t, now)
+		}
+		if t := p.affinity.target(r, usable); t != nil {
+			p.acquireCircuit(t)
+			return t, nil
+		}
+	}
+	var fallback, ejected *upstreamTarget
+	for range p.targets {
+		t := p.targets[p.next%len(p.targets)]
+		p.next++
+		switch {
+		case !p.circuitAllows(t, now):
+		case t.health.ejected:
+			// Outlier detection never ejects every target, but ejected targets are kept just in case.
+			if ejected == nil {
+				ejected = t
+			}
+		case !slices.Contains(tried, t) && !p.skipWarming(t, now):
+			p.acquireCircuit(t)
+			return t, nil
+		case fallback == nil:
+			fallback = t
+		}
+	}
+	for _, t := range []*upstreamTarget{fallback, ejected} {
+		if t != nil {
+			p.acquireCircuit(t)
+			return t, nil
+		}
+	}
+	return nil, &circuitOpenError{retryAfter: p.circuitRetryAfter(now)}
+}
+
+// observe records the result of an attempt to the target for outlier detection and the circuit breaker.
+func (p *targetPool) observe(t *upstreamTarget, r *http.Request, resp *http.Response, err error, elapsed time.Duration) {
+	if p.outlier == nil && p.breaker == nil {
+		return
+	}
+	failed := isTargetFailure(r, resp, err)
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.detectOutlier(t, failed, now)
+	p.recordCircuit(t, failed, elapsed, now)
+}
+
+// RoundTrip implements the RoundTripper interface.
+// Requests beyond the concurrency limit are queued, and errConcurrencyLimit is returned if they cannot be sent.
+func (p *targetPool) RoundTrip(r *http.Request) (*http.Response, error) {
+	l := p.limiter
+	if l == nil {
+		return p.roundTrip(r)
+	}
+	if err := l.acquire(r.Context()); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := p.roundTrip(r)
+	var rtt time.Duration
+	if err == nil {
+		rtt = time.Since(start)
+	}
+	holdUntilClosed(resp, err, func() { l.release(rtt) })
+	return resp, err
+}
+
+// roundTrip sends the request to the picked target and observes the result for outlier detection and the circuit breaker.
+// Failed attempts are retried on another target according to the retry policy.
+// A *circuitOpenError is returned if the circuits of all targets are open.
+func (p *targetPool) roundTrip(r *http.Request) (*http.Response, error) {
+	info := GetInfo(r)
+
+	maxAttempts := 1
+	var body func() io.ReadCloser
+	if rp := p.retry; rp != nil && slices.Contains(rp.methods, r.Method) {
+		b, ok, err := replayBody(r, rp.maxBodySize)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			maxAttempts = rp.maxAttempts
+			body = b
+			p.budget.request()
+		}
+	}
+
+	t, err := p.pick(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	tried := make([]*upstreamTarget, 0, maxAttempts)
+	for attempt := 1; ; attempt++ {
+		tried = append(tried, t)
+
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Scheme = t.url.Scheme
+		r2.URL.Host = t.url.Host
+		if body != nil {
+			r2.Body = body()
+			r2.GetBody = func() (io.ReadCloser, error) { return body(), nil }
+		}
+		if info != nil {
+			info.upstreamAddr = t.addr
+			info.upstreamAttempts = attempt
+		}
+
+		start := time.Now()
+		resp, err := p.retry.attempt(t.transport, r2)
+		p.observe(t, r, resp, err, time.Since(start))
+		if attempt >= maxAttempts || !p.retry.shouldRetry(r, resp, err) || !p.budget.allow() {
+			if err == nil && p.affinity != nil {
+				p.affinity.setCookie(r, resp, t)
+			}
+			return resp, err
+		}
+
+		timer := time.NewTimer(p.retry.delay(attempt))
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, r.Context().Err()
+		case <-timer.C:
+		}
+
+		// The failed response is returned if no target is left to retry on.
+		next, pickErr := p.pick(r, tried)
+		if pickErr != nil {
+			return resp, err
+		}
+		if resp != nil {
+			drainBody(resp)
+		}
+		t = next
+	}
+}
@@ -0,0 +1,54 @@
+package gondola
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestTargetPoolRoundRobin(t *testing.T) {
+	first := newStatusServer(t, "first", http.StatusOK)
+	second := newStatusServer(t, "second", http.StatusOK)
+	third := newStatusServer(t, "third", http.StatusOK)
+
+	tests := []struct {
+		name     string
+		upstream Upstream
+		expected []string
+	}{
+		{
+			name:     "target",
+			upstream: Upstream{HostName: "backend.local", Target: first.URL},
+			expected: []string{"first", "first", "first"},
+		},
+		{
+			name:     "target and targets",
+			upstream: Upstream{HostName: "backend.local", Target: first.URL, Targets: []string{second.URL, third.URL}},
+			expected: []string{"first", "second", "third", "first", "second", "third"},
+		},
+		{
+			name:     "targets only",
+			upstream: Upstream{HostName: "backend.local", Targets: []string{second.URL, third.URL}},
+			expected: []string{"second", "third", "second", "third"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newTargetPool(tt.upstream, nil, slog.Default())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if names := roundTripNames(t, p, len(tt.expected)); !slices.Equal(names, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, names)
+			}
+		})
+	}
+}
+
+func TestNewTargetPoolError(t *testing.T) {
+	if _, err := newTargetPool(Upstream{HostName: "backend.local", Target: "http://backend1:8081", Targets: []string{"http://backend 2"}}, nil, slog.Default()); err == nil {
+		t.Error("Expected error but got none")
+	}
+}
@@ -1,12 +1,14 @@
 package gondola
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"sync"
 	"time"
 )
@@ -18,6 +20,7 @@ type responseInfo struct {
 	xForwardedFor string
 
 	// Request info
+	protocol    string
 	method      string
 	requestURI  string
 	queryString string
@@ -31,14 +34,22 @@ type responseInfo struct {
 	responseTime   float64
 
 	// Upstream info
-	upstreamAddr   string
-	upstreamStatus string
-	upstreamSize   int64
-	upstreamTime   float64
+	upstreamAddr     string
+	upstreamStatus   string
+	upstreamSize     int64
+	upstreamTime     float64
+	upstreamAttempts int
 
 	// Headers
 	referer   string
 	userAgent string
+
+	// TLS info
+	clientCertSubject string
+
+	// gRPC info
+	grpcStatus  string
+	grpcMessage string
 }
 
 type responseWriter struct {
@@ -61,6 +72,37 @@ func (w *responseWriter) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// Flush sends any buffered data to the client, which is required for streaming responses such as gRPC.
+func (w *responseWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack lets the caller take over the connection, which is required for upgrades such as WebSocket.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+// Unwrap returns the underlying http.ResponseWriter for http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// trailerOrHeader returns the value of the given trailer, or of the header if the response has no such trailer.
+// gRPC sends grpc-status and grpc-message as trailers, or as headers in trailers-only responses.
+func trailerOrHeader(h http.Header, key string) string {
+	if v := h.Get(http.TrailerPrefix + key); v != "" {
+		return v
+	}
+	return h.Get(key)
+}
+
 // LogRoundTripper is a RoundTripper that collects information about the request and response.
 type LogRoundTripper struct {
 	transport http.RoundTripper
@@ -105,7 +147,13 @@ func (lrt *LogRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
 	info.upstreamStatus = resp.Status
 	info.upstreamSize = resp.ContentLength
 	info.upstreamTime = time.Since(start).Seconds()
-	info.upstreamAddr = r.URL.Host
+	// The transport may set the address of the target it picked.
+	if info.upstreamAddr == "" {
+		info.upstreamAddr = r.URL.Host
+	}
+	if info.upstreamAttempts == 0 {
+		info.upstreamAttempts = 1
+	}
 
 	return resp, nil
 }
@@ -221,6 +269,7 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		remoteAddr:    host,
 		remotePort:    port,
 		xForwardedFor: r.Header.Get("X-Forwarded-For"),
+		protocol:      r.Proto,
 		method:        r.Method,
 		requestURI:    r.URL.String(),
 		queryString:   r.URL.RawQuery,
@@ -229,16 +278,24 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		referer:       r.Header.Get("Referer"),
 		userAgent:     r.Header.Get("User-Agent"),
 	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		info.clientCertSubject = r.TLS.PeerCertificates[0].Subject.String()
+	}
 
 	r = r.WithContext(ctx)
 	r = SetInfo(r, info)
 
 	h.proxy.ServeHTTP(rw, r)
 
-	info.status = http.StatusText(rw.status)
+	info.status = statusText(rw.status)
 	info.bodyBytesSent = rw.size
 	info.totalBytesSent = rw.size // header size is not calculated at this time
 	info.responseTime = time.Since(start).Seconds()
+	info.grpcStatus = trailerOrHeader(rw.Header(), "Grpc-Status")
+	info.grpcMessage = trailerOrHeader(rw.Header(), "Grpc-Message")
+	if msg, err := url.PathUnescape(info.grpcMessage); err == nil {
+		info.grpcMessage = msg // grpc-message is percent-encoded
+	}
 
 	h.logger.InfoContext(ctx, "access_log",
 		// Client info
@@ -247,6 +304,7 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		slog.String("x_forwarded_for", info.xForwardedFor),
 
 		// Request info
+		slog.String("protocol", info.protocol),
 		slog.String("method", info.method),
 		slog.String("request_uri", info.requestURI),
 		slog.String("query_string", info.queryString),
@@ -264,9 +322,17 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		slog.String("upstream_status", info.upstreamStatus),
 		slog.Int64("upstream_size", info.upstreamSize),
 		slog.Float64("upstream_response_time", info.upstreamTime),
+		slog.Int("upstream_attempts", info.upstreamAttempts),
 
 		// Headers
 		slog.String("referer", info.referer),
 		slog.String("user_agent", info.userAgent),
+
+		// TLS info
+		slog.String("client_cert_subject", info.clientCertSubject),
+
+		// gRPC info
+		slog.String("grpc_status", info.grpcStatus),
+		slog.String("grpc_message", info.grpcMessage),
 	)
 }
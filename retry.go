@@ -0,0 +1,299 @@
+package gondola
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// retryOnConnectError retries attempts that failed to connect to the target.
+	retryOnConnectError = "connect_error"
+	// retryOnTimeout retries attempts that got no response headers within the per-try timeout, or whose TLS handshake timed out.
+	retryOnTimeout = "timeout"
+
+	defaultRetryBackoff          = 25 * time.Millisecond
+	defaultRetryMaxBackoff       = 250 * time.Millisecond
+	defaultRetryMaxBodySize      = 64 << 10
+	defaultRetryBudgetPercent    = 20
+	defaultRetryBudgetMinRetries = 10
+
+	// retryDrainLimit is the maximum response body read to reuse the connection of a retried response.
+	retryDrainLimit = 4 << 10
+)
+
+// idempotentMethods are the request methods retried by default.
+var idempotentMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace,
+}
+
+// retryPolicy is the parsed retry configuration of an upstream.
+type retryPolicy struct {
+	maxAttempts    int
+	onConnectError bool
+	onTimeout      bool
+	statusCodes    []int
+	methods        []string
+	backoff        time.Duration
+	maxBackoff     time.Duration
+	maxBodySize    int64
+	perTryTimeout  time.Duration
+}
+
+// newRetryPolicy validates the retry configuration and returns nil if retries are disabled.
+func newRetryPolicy(c Retry) (*retryPolicy, error) {
+	if c.MaxAttempts < 0 || c.Backoff < 0 || c.MaxBackoff < 0 || c.MaxBodySize < 0 || c.PerTryTimeout < 0 {
+		return nil, errors.New("values must not be negative")
+	}
+	if c.MaxAttempts <= 1 {
+		return nil, nil
+	}
+
+	rp := &retryPolicy{
+		maxAttempts:   c.MaxAttempts,
+		statusCodes:   c.StatusCodes,
+		methods:       idempotentMethods,
+		backoff:       time.Duration(c.Backoff) * time.Millisecond,
+		maxBackoff:    time.Duration(c.MaxBackoff) * time.Millisecond,
+		maxBodySize:   c.MaxBodySize,
+		perTryTimeout: time.Duration(c.PerTryTimeout) * time.Millisecond,
+	}
+	on := c.On
+	if len(on) == 0 {
+		on = []string{retryOnConnectError}
+	}
+	for _, o := range on {
+		switch o {
+		case retryOnConnectError:
+			rp.onConnectError = true
+		case retryOnTimeout:
+			rp.onTimeout = true
+		default:
+			return nil, fmt.Errorf("unsupported retry condition: %s", o)
+		}
+	}
+	for _, code := range c.StatusCodes {
+		if code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid retry status code: %d", code)
+		}
+	}
+	if len(c.Methods) > 0 {
+		rp.methods = make([]string, 0, len(c.Methods))
+		for _, m := range c.Methods {
+			rp.methods = append(rp.methods, strings.ToUpper(m))
+		}
+	}
+	if rp.backoff == 0 {
+		rp.backoff = defaultRetryBackoff
+	}
+	if rp.maxBackoff == 0 {
+		rp.maxBackoff = max(defaultRetryMaxBackoff, rp.backoff)
+	}
+	if rp.maxBackoff < rp.backoff {
+		return nil, errors.New("max_backoff must not be less than backoff")
+	}
+	if rp.maxBodySize == 0 {
+		rp.maxBodySize = defaultRetryMaxBodySize
+	}
+	return rp, nil
+}
+
+// shouldRetry returns true if the result of an attempt matches the retry conditions.
+// Errors caused by the client going away are never retried.
+func (rp *retryPolicy) shouldRetry(r *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		if r.Context().Err() != nil {
+			return false
+		}
+		var atErr *attemptTimeoutError
+		if errors.As(err, &atErr) {
+			return rp.onTimeout
+		}
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return rp.onConnectError
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return rp.onTimeout
+		}
+		return false
+	}
+	return slices.Contains(rp.statusCodes, resp.StatusCode)
+}
+
+// attemptTimeoutError is returned when a target sends no response headers within the per-try timeout.
+type attemptTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *attemptTimeoutError) Error() string {
+	return fmt.Sprintf("no response headers from target within per_try_timeout of %s", e.timeout)
+}
+
+// attempt sends the request with the transport. If the retry policy has a per-try timeout, the attempt is cancelled
+// and an *attemptTimeoutError is returned when no response headers arrive in time. The response body is not limited.
+func (rp *retryPolicy) attempt(rt http.RoundTripper, r *http.Request) (*http.Response, error) {
+	if rp == nil || rp.perTryTimeout == 0 {
+		return rt.RoundTrip(r)
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	timer := time.AfterFunc(rp.perTryTimeout, cancel)
+	resp, err := rt.RoundTrip(r.WithContext(ctx))
+	if !timer.Stop() {
+		// The attempt was cancelled, even if the response headers arrived meanwhile.
+		if err == nil {
+			resp.Body.Close()
+		}
+		if r.Context().Err() != nil {
+			return nil, r.Context().Err()
+		}
+		return nil, &attemptTimeoutError{timeout: rp.perTryTimeout}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The context of the attempt is released with the response body, which stays an io.ReadWriteCloser for upgrades.
+	if rwc, ok := resp.Body.(io.ReadWriteCloser); ok {
+		resp.Body = &cancelReadWriteCloser{ReadWriteCloser: rwc, cancel: cancel}
+	} else {
+		resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	}
+	return resp, nil
+}
+
+// cancelBody cancels the context of an attempt when the response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// cancelReadWriteCloser cancels the context of an attempt when the upgraded connection is closed.
+type cancelReadWriteCloser struct {
+	io.ReadWriteCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelReadWriteCloser) Close() error {
+	err := b.ReadWriteCloser.Close()
+	b.cancel()
+	return err
+}
+
+// delay returns the backoff before the nth retry, a random duration up to the doubled backoff.
+func (rp *retryPolicy) delay(n int) time.Duration {
+	d := rp.backoff
+	for i := 1; i < n && d < rp.maxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, rp.maxBackoff)
+	return rand.N(d + 1)
+}
+
+// replayBody buffers the request body up to limit bytes so that it can be sent again.
+// It returns false if the body is larger than limit, in which case r.Body still returns the whole body.
+func replayBody(r *http.Request, limit int64) (func() io.ReadCloser, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return func() io.ReadCloser { return r.Body }, true, nil
+	}
+	if r.ContentLength > limit {
+		return nil, false, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		r.Body.Close()
+		return nil, false, err
+	}
+	if int64(len(buf)) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return nil, false, nil
+	}
+	r.Body.Close()
+	return func() io.ReadCloser { return io.NopCloser(bytes.NewReader(buf)) }, true, nil
+}
+
+// drainBody discards the rest of a response body that is not returned to the client, so that the connection can be reused.
+func drainBody(resp *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, retryDrainLimit))
+	resp.Body.Close()
+}
+
+// retryBudget limits the retries of all upstreams to a percentage of the requests within a second.
+type retryBudget struct {
+	percent    int
+	minRetries int
+
+	mu       sync.Mutex
+	start    time.Time
+	requests int
+	retries  int
+}
+
+// newRetryBudget validates the retry budget configuration.
+func newRetryBudget(c RetryBudget) (*retryBudget, error) {
+	if c.Percent < 0 || c.MinRetries < 0 {
+		return nil, errors.New("invalid retry_budget: values must not be negative")
+	}
+	b := &retryBudget{percent: c.Percent, minRetries: c.MinRetries}
+	if b.percent == 0 {
+		b.percent = defaultRetryBudgetPercent
+	}
+	if b.minRetries == 0 {
+		b.minRetries = defaultRetryBudgetMinRetries
+	}
+	return b, nil
+}
+
+// reset starts a new window if the current one is over. The caller must hold b.mu.
+func (b *retryBudget) reset(now time.Time) {
+	if now.Sub(b.start) >= time.Second {
+		b.start = now
+		b.requests = 0
+		b.retries = 0
+	}
+}
+
+// request records a request that may be retried.
+func (b *retryBudget) request() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reset(time.Now())
+	b.requests++
+}
+
+// allow reports whether a retry is within the budget and records it if so.
+func (b *retryBudget) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reset(time.Now())
+	if b.retries >= b.minRetries+b.requests*b.percent/100 {
+		return false
+	}
+	b.retries++
+	return true
+}
@@ -0,0 +1,281 @@
+package gondola
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        Retry
+		expected      *retryPolicy
+		expectedError bool
+	}{
+		{name: "disabled", config: Retry{}},
+		{name: "single attempt", config: Retry{MaxAttempts: 1}},
+		{
+			name:   "defaults",
+			config: Retry{MaxAttempts: 3},
+			expected: &retryPolicy{
+				maxAttempts:    3,
+				onConnectError: true,
+				methods:        idempotentMethods,
+				backoff:        defaultRetryBackoff,
+				maxBackoff:     defaultRetryMaxBackoff,
+				maxBodySize:    defaultRetryMaxBodySize,
+			},
+		},
+		{
+			name:   "custom",
+			config: Retry{MaxAttempts: 2, On: []string{"timeout"}, StatusCodes: []int{503}, Methods: []string{"post"}, Backoff: 100, MaxBackoff: 1000, MaxBodySize: 1024, PerTryTimeout: 2000},
+			expected: &retryPolicy{
+				maxAttempts:   2,
+				onTimeout:     true,
+				statusCodes:   []int{503},
+				methods:       []string{http.MethodPost},
+				backoff:       100 * time.Millisecond,
+				maxBackoff:    time.Second,
+				maxBodySize:   1024,
+				perTryTimeout: 2 * time.Second,
+			},
+		},
+		{name: "negative", config: Retry{MaxAttempts: -1}, expectedError: true},
+		{name: "negative per-try timeout", config: Retry{MaxAttempts: 2, PerTryTimeout: -1}, expectedError: true},
+		{name: "unsupported condition", config: Retry{MaxAttempts: 2, On: []string{"reset"}}, expectedError: true},
+		{name: "invalid status code", config: Retry{MaxAttempts: 2, StatusCodes: []int{600}}, expectedError: true},
+		{name: "max backoff less than backoff", config: Retry{MaxAttempts: 2, Backoff: 100, MaxBackoff: 10}, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := newRetryPolicy(tt.config)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tt.expected == nil {
+				if actual != nil {
+					t.Errorf("Expected retries to be disabled, got %+v", actual)
+				}
+				return
+			}
+			if actual.maxAttempts != tt.expected.maxAttempts || actual.onConnectError != tt.expected.onConnectError || actual.onTimeout != tt.expected.onTimeout {
+				t.Errorf("Expected %+v, got %+v", tt.expected, actual)
+			}
+			if strings.Join(actual.methods, ",") != strings.Join(tt.expected.methods, ",") {
+				t.Errorf("Expected methods %v, got %v", tt.expected.methods, actual.methods)
+			}
+			if len(actual.statusCodes) != len(tt.expected.statusCodes) {
+				t.Errorf("Expected status codes %v, got %v", tt.expected.statusCodes, actual.statusCodes)
+			}
+			if actual.backoff != tt.expected.backoff || actual.maxBackoff != tt.expected.maxBackoff || actual.maxBodySize != tt.expected.maxBodySize {
+				t.Errorf("Expected %+v, got %+v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	rp := &retryPolicy{backoff: 10 * time.Millisecond, maxBackoff: 40 * time.Millisecond}
+	for n, limit := range map[int]time.Duration{1: 10 * time.Millisecond, 2: 20 * time.Millisecond, 3: 40 * time.Millisecond, 10: 40 * time.Millisecond} {
+		for range 100 {
+			if d := rp.delay(n); d < 0 || d > limit {
+				t.Fatalf("Expected delay of retry %d up to %v, got %v", n, limit, d)
+			}
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b, err := newRetryBudget(RetryBudget{Percent: 50, MinRetries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 4 {
+		b.request()
+	}
+	// 1 retry plus 50% of 4 requests.
+	for i := range 3 {
+		if !b.allow() {
+			t.Fatalf("Expected retry %d to be allowed", i+1)
+		}
+	}
+	if b.allow() {
+		t.Error("Expected retry to exceed the budget")
+	}
+
+	if _, err := newRetryBudget(RetryBudget{Percent: -1}); err == nil {
+		t.Error("Expected error but got none")
+	}
+}
+
+// unusedAddr returns an address that refuses connections.
+func unusedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestRetry(t *testing.T) {
+	// flaky fails every other request with 503 and echoes the request body.
+	var count atomic.Int64
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if count.Add(1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
+	}))
+	defer flaky.Close()
+	healthy := newStatusServer(t, "healthy", http.StatusOK)
+	// hanging sends no response until the attempt is given up.
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hanging.Close()
+	// slowBody sends the response headers at once and the body after a while.
+	slowBody := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer slowBody.Close()
+
+	tests := []struct {
+		name             string
+		upstream         Upstream
+		method           string
+		body             string
+		expectedStatus   int
+		expectedBody     string
+		expectedAttempts int
+	}{
+		{
+			name:             "connect error on another target",
+			upstream:         Upstream{Target: "http://" + unusedAddr(t), Targets: []string{healthy.URL}, Retry: Retry{MaxAttempts: 2}},
+			method:           http.MethodGet,
+			expectedStatus:   http.StatusOK,
+			expectedBody:     "healthy",
+			expectedAttempts: 2,
+		},
+		{
+			name:             "connect error not retried",
+			upstream:         Upstream{Target: "http://" + unusedAddr(t), Targets: []string{healthy.URL}},
+			method:           http.MethodGet,
+			expectedAttempts: 1,
+		},
+		{
+			name:             "timeout on another target",
+			upstream:         Upstream{Target: hanging.URL, Targets: []string{healthy.URL}, Retry: Retry{MaxAttempts: 2, On: []string{"timeout"}, PerTryTimeout: 100}},
+			method:           http.MethodGet,
+			expectedStatus:   http.StatusOK,
+			expectedBody:     "healthy",
+			expectedAttempts: 2,
+		},
+		{
+			name:             "timeout not retried",
+			upstream:         Upstream{Target: hanging.URL, Targets: []string{healthy.URL}, Retry: Retry{MaxAttempts: 2, PerTryTimeout: 100}},
+			method:           http.MethodGet,
+			expectedAttempts: 1,
+		},
+		{
+			name:             "per-try timeout does not limit the body",
+			upstream:         Upstream{Target: slowBody.URL, Retry: Retry{MaxAttempts: 2, On: []string{"timeout"}, PerTryTimeout: 100}},
+			method:           http.MethodGet,
+			expectedStatus:   http.StatusOK,
+			expectedBody:     "slow",
+			expectedAttempts: 1,
+		},
+		{
+			name:             "status code",
+			upstream:         Upstream{Target: flaky.URL, Retry: Retry{MaxAttempts: 3, StatusCodes: []int{503}}},
+			method:           http.MethodGet,
+			expectedStatus:   http.StatusOK,
+			expectedAttempts: 2,
+		},
+		{
+			name:             "non-idempotent method",
+			upstream:         Upstream{Target: flaky.URL, Retry: Retry{MaxAttempts: 3, StatusCodes: []int{503}}},
+			method:           http.MethodPost,
+			body:             "payload",
+			expectedStatus:   http.StatusServiceUnavailable,
+			expectedAttempts: 1,
+		},
+		{
+			name:             "body replay",
+			upstream:         Upstream{Target: flaky.URL, Retry: Retry{MaxAttempts: 3, StatusCodes: []int{503}, Methods: []string{"POST"}}},
+			method:           http.MethodPost,
+			body:             "payload",
+			expectedStatus:   http.StatusOK,
+			expectedBody:     "payload",
+			expectedAttempts: 2,
+		},
+		{
+			name:             "body over max body size",
+			upstream:         Upstream{Target: flaky.URL, Retry: Retry{MaxAttempts: 3, StatusCodes: []int{503}, Methods: []string{"POST"}, MaxBodySize: 4}},
+			method:           http.MethodPost,
+			body:             "payload",
+			expectedStatus:   http.StatusServiceUnavailable,
+			expectedAttempts: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			count.Store(0)
+			tt.upstream.HostName = "backend.local"
+			p, err := newTargetPool(tt.upstream, nil, slog.Default())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(tt.method, "http://backend.local/", strings.NewReader(tt.body))
+			// The request body is unknown to the pool when it is streamed.
+			req.ContentLength = -1
+			info := &responseInfo{}
+			req = SetInfo(req, info)
+			res, err := p.RoundTrip(req)
+			if info.upstreamAttempts != tt.expectedAttempts {
+				t.Errorf("Expected %d attempts, got %d", tt.expectedAttempts, info.upstreamAttempts)
+			}
+			if tt.expectedStatus == 0 {
+				if err == nil {
+					res.Body.Close()
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			if res.StatusCode != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, res.StatusCode)
+			}
+			if tt.expectedBody != "" && string(body) != tt.expectedBody {
+				t.Errorf("Expected body %q, got %q", tt.expectedBody, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package gondola
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// router is a http.Handler that serves static files and proxies requests to upstreams.
+type router struct {
+	config *Config
+	mux    *http.ServeMux
+	budget *retryBudget
+	logger *slog.Logger
+	// docker finds upstreams from containers, or is nil if it is disabled.
+	docker *dockerProvider
+
+	mu          sync.RWMutex
+	upstreams   map[string]*upstream
+	dockerHosts map[string]bool // host names of the upstreams of containers
+	middlewares []Middleware
+	handler     http.Handler
+}
+
+// newRouter creates a new router with the given configuration.
+func newRouter(c *Config) (*router, error) {
+	logger := NewLogger(c.LogLevel)
+
+	budget, err := newRetryBudget(c.Proxy.RetryBudget)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate upstream configurations first
+	upstreams := make(map[string]*upstream, len(c.Upstreams))
+	for _, u := range c.Upstreams {
+		us, err := newUpstream(c, u, budget, logger.Logger)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := upstreams[u.HostName]; !ok {
+			upstreams[u.HostName] = us
+		}
+	}
+
+	rt := &router{
+		config:      c,
+		mux:         http.NewServeMux(),
+		budget:      budget,
+		logger:      logger.Logger,
+		upstreams:   upstreams,
+		dockerHosts: make(map[string]bool),
+	}
+	if c.Proxy.Docker.Enabled {
+		d, err := newDockerProvider(c.Proxy.Docker)
+		if err != nil {
+			return nil, err
+		}
+		rt.docker = d
+	}
+
+	// Create a main handler that will handle both static files and proxy requests
+	rt.mux.HandleFunc("/", rt.serveRoot)
+
+	// Handle favicon.ico requests
+	rt.mux.HandleFunc("/favicon.ico", rt.serveFavicon)
+
+	rt.handler = rt.mux
+	return rt, nil
+}
+
+// use registers middlewares that are applied to all requests.
+func (rt *router) use(mws ...Middleware) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.middlewares = append(rt.middlewares, mws...)
+	rt.handler = chain(rt.mux, rt.middlewares)
+}
+
+// useUpstream registers middlewares that are applied to requests for the upstream with the given host name.
+func (rt *router) useUpstream(hostName string, mws ...Middleware) error {
+	us, ok := rt.lookupUpstream(hostName)
+	if !ok {
+		return fmt.Errorf("upstream %s is not configured", hostName)
+	}
+	us.use(mws...)
+	return nil
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.mu.RLock()
+	h := rt.handler
+	rt.mu.RUnlock()
+	h.ServeHTTP(w, r)
+}
+
+func (rt *router) serveRoot(w http.ResponseWriter, r *http.Request) {
+	// First, try to serve static files
+	for _, sf := range rt.config.Proxy.StaticFiles {
+		// Check if the request path starts with the configured path
+		if strings.HasPrefix(r.URL.Path, sf.Path) {
+			serveStaticFile(w, r, sf)
+			return
+		}
+	}
+
+	// If no static file is matched, try to proxy the request
+	if us, ok := rt.lookupUpstream(r.Host); ok {
+		us.ServeHTTP(w, r)
+	}
+}
+
+// lookupUpstream returns the upstream with the given host name.
+func (rt *router) lookupUpstream(hostName string) (*upstream, bool) {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	us, ok := rt.upstreams[hostName]
+	return us, ok
+}
+
+func (rt *router) serveFavicon(w http.ResponseWriter, r *http.Request) {
+	for _, sf := range rt.config.Proxy.StaticFiles {
+		if _, err := os.Stat(filepath.Join(sf.Dir, "favicon.ico")); err == nil {
+			http.ServeFile(w, r, filepath.Join(sf.Dir, "favicon.ico"))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// hostWithoutPort returns the host without the port, if any.
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func serveStaticFile(w http.ResponseWriter, r *http.Request, sf StaticFile) {
+	p := strings.TrimPrefix(r.URL.Path, sf.Path)
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = p
+
+	fullPath := filepath.Join(sf.Dir, p)
+	fileInfo, err := os.Stat(fullPath)
+
+	// Always use fallback for directory requests or non-existent files
+	var useFallback bool
+	if err != nil {
+		useFallback = true
+	} else if fileInfo.IsDir() {
+		// If directory and has index.html, serve it
+		indexPath := filepath.Join(fullPath, "index.html")
+		if _, err := os.Stat(indexPath); err == nil {
+			http.ServeFile(w, r2, indexPath)
+			return
+		}
+		useFallback = true
+	}
+
+	if useFallback {
+		fallbackFile := "index.html"
+		if sf.FallbackPath != "" {
+			fallbackFile = sf.FallbackPath
+		}
+		http.ServeFile(w, r2, filepath.Join(sf.Dir, fallbackFile))
+		return
+	}
+
+	// Serve the existing file
+	http.ServeFile(w, r2, fullPath)
+}
@@ -0,0 +1,32 @@
+package gondola
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// slowStartMinWeight is the fraction of its share of traffic that a target receives when it starts warming up.
+const slowStartMinWeight = 0.1
+
+// warmUp starts the slow start of a target that joined the pool or recovered. The caller must hold p.mu.
+func (p *targetPool) warmUp(t *upstreamTarget, now time.Time) {
+	if p.slowStart > 0 {
+		t.warmingSince = now
+	}
+}
+
+// skipWarming returns true if the balancer should skip a warming target for this request.
+// The probability of picking the target ramps linearly from slowStartMinWeight to 1 over the slow start duration.
+// The caller must hold p.mu.
+func (p *targetPool) skipWarming(t *upstreamTarget, now time.Time) bool {
+	if t.warmingSince.IsZero() {
+		return false
+	}
+	elapsed := now.Sub(t.warmingSince)
+	if elapsed >= p.slowStart {
+		t.warmingSince = time.Time{}
+		return false
+	}
+	weight := max(slowStartMinWeight, float64(elapsed)/float64(p.slowStart))
+	return rand.Float64() >= weight
+}
@@ -0,0 +1,139 @@
+package gondola
+
+import (
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSkipWarming(t *testing.T) {
+	p := &targetPool{slowStart: time.Second}
+	now := time.Now()
+
+	tests := []struct {
+		name           string
+		warmingSince   time.Time
+		expectedWeight float64
+	}{
+		{name: "not warming", expectedWeight: 1},
+		{name: "just joined", warmingSince: now, expectedWeight: slowStartMinWeight},
+		{name: "halfway", warmingSince: now.Add(-500 * time.Millisecond), expectedWeight: 0.5},
+		{name: "warmed up", warmingSince: now.Add(-time.Second), expectedWeight: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const n = 10000
+			picked := 0
+			for range n {
+				target := &upstreamTarget{warmingSince: tt.warmingSince}
+				if !p.skipWarming(target, now) {
+					picked++
+				}
+			}
+			if weight := float64(picked) / n; math.Abs(weight-tt.expectedWeight) > 0.05 {
+				t.Errorf("Expected weight %v, got %v", tt.expectedWeight, weight)
+			}
+		})
+	}
+
+	target := &upstreamTarget{warmingSince: now.Add(-2 * time.Second)}
+	p.skipWarming(target, now)
+	if !target.warmingSince.IsZero() {
+		t.Error("Expected slow start to end after its duration")
+	}
+}
+
+func TestSlowStartAfterReadmission(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	recovering := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte("recovering"))
+	}))
+	defer recovering.Close()
+	healthy := newStatusServer(t, "healthy", http.StatusOK)
+
+	p, err := newTargetPool(Upstream{
+		HostName:         "backend.local",
+		Targets:          []string{recovering.URL, healthy.URL},
+		OutlierDetection: OutlierDetection{ConsecutiveErrors: 1, BaseEjectionTime: 50},
+		SlowStart:        60000,
+	}, nil, slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roundTripNames(t, p, 2)
+	failing.Store(false)
+	time.Sleep(100 * time.Millisecond)
+
+	count := 0
+	for _, name := range roundTripNames(t, p, 200) {
+		if name == "recovering" {
+			count++
+		}
+	}
+	// The recovering target gets about a tenth of its share of half the requests.
+	if count == 0 || count > 30 {
+		t.Errorf("Expected the recovering target to receive a small share of 200 requests, got %d", count)
+	}
+}
+
+func TestSlowStartWithAffinity(t *testing.T) {
+	tests := []struct {
+		name     string
+		affinity Affinity
+		header   string
+	}{
+		{name: "hash", affinity: Affinity{Type: "hash", HashOn: "header", HashKey: "X-User-ID"}, header: "X-User-ID"},
+		{name: "cookie", affinity: Affinity{Type: "cookie", CookieSecret: "secret"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newAffinityPool(t, tt.affinity)
+
+			// Find the requests that have affinity with the first target before it starts warming.
+			var clients []func(r *http.Request)
+			for i := 0; len(clients) < 100 && i < 10000; i++ {
+				user := "user" + strconv.Itoa(i)
+				fn := func(r *http.Request) {}
+				if tt.header != "" {
+					fn = func(r *http.Request) { r.Header.Set(tt.header, user) }
+				}
+				name, res := roundTripWith(t, p, fn)
+				if name != "backend0" {
+					continue
+				}
+				if cookies := res.Cookies(); len(cookies) == 1 {
+					cookie := cookies[0]
+					fn = func(r *http.Request) { r.AddCookie(cookie) }
+				}
+				clients = append(clients, fn)
+			}
+
+			p.slowStart = time.Minute
+			p.targets[0].warmingSince = time.Now()
+
+			count := 0
+			for _, fn := range clients {
+				if name, _ := roundTripWith(t, p, fn); name == "backend0" {
+					count++
+				}
+			}
+			// The warming target gets about a tenth of the requests that have affinity with it.
+			if count > 30 {
+				t.Errorf("Expected the warming target to receive a small share of %d requests, got %d", len(clients), count)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package gondola
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// flushImmediate is the flush_interval value that flushes after each write.
+const flushImmediate = "immediate"
+
+// eventStreamContentType is the content type of Server-Sent Events.
+const eventStreamContentType = "text/event-stream"
+
+// parseFlushInterval parses the flush_interval of an upstream into the FlushInterval of httputil.ReverseProxy.
+// "immediate" flushes after each write, a duration such as "100ms" flushes periodically, and an empty value uses the default.
+func parseFlushInterval(s string) (time.Duration, error) {
+	switch s {
+	case "":
+		return 0, nil
+	case flushImmediate:
+		return -1, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid flush_interval %q, must be %q or a positive duration", s, flushImmediate)
+	}
+	return d, nil
+}
+
+// isEventStream returns true if the content type is Server-Sent Events.
+func isEventStream(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == eventStreamContentType
+}
+
+// acceptsEventStream returns true if the request asks for Server-Sent Events.
+func acceptsEventStream(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		if isEventStream(strings.TrimSpace(v)) {
+			return true
+		}
+	}
+	return false
+}
+
+// disableEventStreamCompression asks the upstream not to compress Server-Sent Events,
+// which would hold back events until the compressor flushes.
+func disableEventStreamCompression(r *http.Request) {
+	if acceptsEventStream(r) {
+		r.Header.Set("Accept-Encoding", "identity")
+	}
+}
+
+// modifyEventStream disables buffering of Server-Sent Events responses.
+// httputil.ReverseProxy already flushes them immediately, and X-Accel-Buffering tells proxies in front of gondola to do the same.
+func modifyEventStream(res *http.Response) error {
+	if !isEventStream(res.Header.Get("Content-Type")) {
+		return nil
+	}
+	res.Header.Set("X-Accel-Buffering", "no")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	if res.Header.Get("Cache-Control") == "" {
+		res.Header.Set("Cache-Control", "no-cache")
+	}
+	return nil
+}
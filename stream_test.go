@@ -0,0 +1,147 @@
+package gondola
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseFlushInterval(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		expected      time.Duration
+		expectedError bool
+	}{
+		{name: "default", value: "", expected: 0},
+		{name: "immediate", value: "immediate", expected: -1},
+		{name: "duration", value: "100ms", expected: 100 * time.Millisecond},
+		{name: "zero duration", value: "0s", expectedError: true},
+		{name: "negative duration", value: "-1s", expectedError: true},
+		{name: "invalid", value: "always", expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := parseFlushInterval(tt.value)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if d != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, d)
+			}
+		})
+	}
+}
+
+func TestStreamingResponses(t *testing.T) {
+	tests := []struct {
+		name          string
+		flushInterval string
+		accept        string
+		contentType   string
+		contentLength string
+		first         string
+		rest          string
+		expectedAE    string
+		expectedXAB   string
+	}{
+		{
+			name:        "server-sent events",
+			accept:      "text/event-stream",
+			contentType: "text/event-stream; charset=utf-8",
+			first:       "data: first\n\n",
+			rest:        "data: second\n\n",
+			expectedAE:  "identity",
+			expectedXAB: "no",
+		},
+		{
+			name:          "immediate flush of a response with known length",
+			flushInterval: "immediate",
+			contentType:   "text/plain",
+			contentLength: "10",
+			first:         "first",
+			rest:          "-rest",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			acceptEncoding := make(chan string, 1)
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				acceptEncoding <- r.Header.Get("Accept-Encoding")
+				w.Header().Set("Content-Type", tt.contentType)
+				if tt.contentLength != "" {
+					w.Header().Set("Content-Length", tt.contentLength)
+				}
+				w.Write([]byte(tt.first))
+				w.(http.Flusher).Flush()
+				<-release
+				w.Write([]byte(tt.rest))
+			}))
+			defer backend.Close()
+			defer close(release)
+
+			g, err := NewGondolaFromConfig(NewConfig(
+				WithUpstream(Upstream{HostName: "stream.local", Target: backend.URL, FlushInterval: tt.flushInterval}),
+			))
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			proxy := httptest.NewServer(g.Handler())
+			defer proxy.Close()
+
+			req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = "stream.local"
+			req.Header.Set("Accept-Encoding", "gzip")
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			client := &http.Client{Timeout: 2 * time.Second}
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if ae := <-acceptEncoding; tt.expectedAE != "" && ae != tt.expectedAE {
+				t.Errorf("Expected Accept-Encoding %s, got %s", tt.expectedAE, ae)
+			}
+			if xab := res.Header.Get("X-Accel-Buffering"); xab != tt.expectedXAB {
+				t.Errorf("Expected X-Accel-Buffering %q, got %q", tt.expectedXAB, xab)
+			}
+
+			// The first part must arrive while the backend is still holding back the rest.
+			got := make([]byte, len(tt.first))
+			done := make(chan error, 1)
+			go func() {
+				_, err := io.ReadFull(bufio.NewReader(res.Body), got)
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("Expected the first part to be flushed before the response completes")
+			}
+			if string(got) != tt.first {
+				t.Errorf("Expected %q, got %q", tt.first, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package gondola
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hstsPreloadMinMaxAge is the minimum max-age in seconds required for HSTS preload lists.
+const hstsPreloadMinMaxAge = 31536000
+
+// sessionTicketKeyCount is the number of session ticket keys kept, so that tickets issued before a rotation are still accepted.
+const sessionTicketKeyCount = 3
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"P-256":          tls.CurveP256,
+	"P-384":          tls.CurveP384,
+	"P-521":          tls.CurveP521,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+}
+
+// tlsOptions is the parsed hardening options of TLS listeners.
+type tlsOptions struct {
+	minVersion   uint16
+	maxVersion   uint16
+	cipherSuites []uint16
+	curves       []tls.CurveID
+	nextProtos   []string
+	hsts         string
+}
+
+// parseTLSOptions validates and parses the hardening options of TLS listeners.
+func parseTLSOptions(t TLS) (*tlsOptions, error) {
+	opts := &tlsOptions{
+		nextProtos: []string{"h2", "http/1.1"},
+	}
+
+	for _, v := range []struct {
+		name  string
+		value string
+		dst   *uint16
+	}{
+		{name: "min_version", value: t.MinVersion, dst: &opts.minVersion},
+		{name: "max_version", value: t.MaxVersion, dst: &opts.maxVersion},
+	} {
+		if v.value == "" {
+			continue
+		}
+		version, ok := tlsVersions[v.value]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS %s: %s", v.name, v.value)
+		}
+		*v.dst = version
+	}
+	if opts.minVersion != 0 && opts.maxVersion != 0 && opts.minVersion > opts.maxVersion {
+		return nil, fmt.Errorf("TLS min_version %s is greater than max_version %s", t.MinVersion, t.MaxVersion)
+	}
+
+	for _, name := range t.CipherSuites {
+		idx := slices.IndexFunc(tls.CipherSuites(), func(cs *tls.CipherSuite) bool {
+			return cs.Name == name
+		})
+		if idx < 0 {
+			return nil, fmt.Errorf("unsupported or insecure TLS cipher suite: %s", name)
+		}
+		cs := tls.CipherSuites()[idx]
+		if slices.Equal(cs.SupportedVersions, []uint16{tls.VersionTLS13}) {
+			return nil, fmt.Errorf("TLS 1.3 cipher suite %s is not configurable", name)
+		}
+		opts.cipherSuites = append(opts.cipherSuites, cs.ID)
+	}
+
+	for _, name := range t.CurvePreferences {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS curve: %s", name)
+		}
+		opts.curves = append(opts.curves, curve)
+	}
+
+	if t.SessionTicketKeyRotation < 0 {
+		return nil, fmt.Errorf("invalid TLS session_ticket_key_rotation: %d", t.SessionTicketKeyRotation)
+	}
+
+	if len(t.ALPN) > 0 {
+		for _, proto := range t.ALPN {
+			if proto == "" {
+				return nil, errors.New("TLS alpn must not contain an empty protocol")
+			}
+		}
+		opts.nextProtos = t.ALPN
+	}
+
+	if err := t.ClientAuth.validate(); err != nil {
+		return nil, err
+	}
+
+	hsts, err := hstsHeader(t.HSTS)
+	if err != nil {
+		return nil, err
+	}
+	opts.hsts = hsts
+
+	return opts, nil
+}
+
+// hstsHeader returns the value of the Strict-Transport-Security header, or an empty string if HSTS is disabled.
+func hstsHeader(h HSTS) (string, error) {
+	if h.MaxAge < 0 {
+		return "", fmt.Errorf("invalid HSTS max_age: %d", h.MaxAge)
+	}
+	if h.MaxAge == 0 {
+		if h.IncludeSubDomains || h.Preload {
+			return "", errors.New("HSTS max_age must be set to enable include_subdomains or preload")
+		}
+		return "", nil
+	}
+	if h.Preload && (h.MaxAge < hstsPreloadMinMaxAge || !h.IncludeSubDomains) {
+		return "", fmt.Errorf("HSTS preload requires max_age of at least %d and include_subdomains", hstsPreloadMinMaxAge)
+	}
+
+	v := "max-age=" + strconv.Itoa(h.MaxAge)
+	if h.IncludeSubDomains {
+		v += "; includeSubDomains"
+	}
+	if h.Preload {
+		v += "; preload"
+	}
+	return v, nil
+}
+
+// withHSTS returns a handler that adds the Strict-Transport-Security header to responses.
+func withHSTS(next http.Handler, value string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isEnableTLS returns true if any certificate is configured for the proxy server or its upstreams.
+func isEnableTLS(c *Config) bool {
+	return c.Proxy.IsEnableTLS() || hasCertificates(c)
+}
+
+// hasCertificates returns true if static certificates are configured for the proxy server or its upstreams.
+func hasCertificates(c *Config) bool {
+	if c.Proxy.hasCertificates() {
+		return true
+	}
+	for _, u := range c.Upstreams {
+		if u.TLSCertPath != "" && u.TLSKeyPath != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// newTLSConfig creates the TLS configuration used by TLS listeners.
+// Static certificates are watched for changes, and reloaded when reload receives, until the context is cancelled.
+// If ACME is enabled, certificates are obtained automatically and static certificates are used as a fallback.
+func newTLSConfig(ctx context.Context, c *Config, am *acmeManager, reload <-chan struct{}) (*tls.Config, error) {
+	opts, err := parseTLSOptions(c.Proxy.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	var store *certStore
+	if hasCertificates(c) {
+		s, err := newCertStore(c)
+		if err != nil {
+			return nil, err
+		}
+		go s.watch(ctx, reload)
+		store = s
+	}
+
+	cfg := &tls.Config{
+		MinVersion:       opts.minVersion,
+		MaxVersion:       opts.maxVersion,
+		CipherSuites:     opts.cipherSuites,
+		CurvePreferences: opts.curves,
+		NextProtos:       opts.nextProtos,
+	}
+	if am == nil {
+		cfg.GetCertificate = store.GetCertificate
+	} else {
+		am.fallback = store
+		go am.obtain(ctx)
+		cfg.GetCertificate = am.GetCertificate
+		cfg.NextProtos = am.nextProtos(opts.nextProtos)
+	}
+
+	if err := applyClientAuth(cfg, c.Proxy.TLS.ClientAuth); err != nil {
+		return nil, err
+	}
+	configs := []*tls.Config{cfg}
+
+	// Upstreams with their own client certificate authentication are served with a configuration selected by SNI.
+	byHost := make(map[string]*tls.Config)
+	for _, u := range c.Upstreams {
+		if u.ClientAuth.Mode == "" {
+			continue
+		}
+		hc := cfg.Clone()
+		if err := applyClientAuth(hc, u.ClientAuth); err != nil {
+			return nil, err
+		}
+		byHost[strings.ToLower(hostWithoutPort(u.HostName))] = hc
+		configs = append(configs, hc)
+	}
+
+	if c.Proxy.TLS.SessionTicketKeyRotation > 0 {
+		r := &ticketKeyRotator{configs: configs}
+		if err := r.rotate(); err != nil {
+			return nil, err
+		}
+		go r.run(ctx, time.Duration(c.Proxy.TLS.SessionTicketKeyRotation)*time.Millisecond)
+	}
+
+	// http.Server clones its TLS configuration when it starts serving, so the configuration is returned
+	// via GetConfigForClient to let rotated session ticket keys take effect for new handshakes.
+	return &tls.Config{
+		NextProtos: cfg.NextProtos,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if hc, ok := byHost[strings.ToLower(hello.ServerName)]; ok {
+				return hc, nil
+			}
+			return cfg, nil
+		},
+	}, nil
+}
+
+// ticketKeyRotator rotates the session ticket keys of TLS configurations.
+type ticketKeyRotator struct {
+	mu      sync.Mutex
+	configs []*tls.Config
+	keys    [][32]byte
+}
+
+// rotate generates a new session ticket key and keeps the previous ones for decryption.
+func (r *ticketKeyRotator) rotate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return fmt.Errorf("error generating session ticket key: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = append([][32]byte{key}, r.keys...)
+	if len(r.keys) > sessionTicketKeyCount {
+		r.keys = r.keys[:sessionTicketKeyCount]
+	}
+	for _, cfg := range r.configs {
+		cfg.SetSessionTicketKeys(r.keys)
+	}
+	return nil
+}
+
+// run rotates the session ticket keys at the given interval until the context is cancelled.
+func (r *ticketKeyRotator) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.rotate(); err != nil {
+				slog.Error(err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package gondola
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseTLSOptions(t *testing.T) {
+	tests := []struct {
+		name          string
+		tls           TLS
+		expected      *tlsOptions
+		expectedError bool
+	}{
+		{
+			name: "default",
+			tls:  TLS{},
+			expected: &tlsOptions{
+				nextProtos: []string{"h2", "http/1.1"},
+			},
+		},
+		{
+			name: "hardened",
+			tls: TLS{
+				MinVersion:       "1.2",
+				MaxVersion:       "1.3",
+				CipherSuites:     []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+				CurvePreferences: []string{"X25519", "P-256"},
+				ALPN:             []string{"http/1.1"},
+				HSTS:             HSTS{MaxAge: 31536000, IncludeSubDomains: true, Preload: true},
+			},
+			expected: &tlsOptions{
+				minVersion:   tls.VersionTLS12,
+				maxVersion:   tls.VersionTLS13,
+				cipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+				curves:       []tls.CurveID{tls.X25519, tls.CurveP256},
+				nextProtos:   []string{"http/1.1"},
+				hsts:         "max-age=31536000; includeSubDomains; preload",
+			},
+		},
+		{
+			name:          "invalid min version",
+			tls:           TLS{MinVersion: "1.4"},
+			expectedError: true,
+		},
+		{
+			name:          "min version greater than max version",
+			tls:           TLS{MinVersion: "1.3", MaxVersion: "1.2"},
+			expectedError: true,
+		},
+		{
+			name:          "insecure cipher suite",
+			tls:           TLS{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+			expectedError: true,
+		},
+		{
+			name:          "TLS 1.3 cipher suite",
+			tls:           TLS{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+			expectedError: true,
+		},
+		{
+			name:          "unsupported curve",
+			tls:           TLS{CurvePreferences: []string{"P-224"}},
+			expectedError: true,
+		},
+		{
+			name:          "negative session ticket key rotation",
+			tls:           TLS{SessionTicketKeyRotation: -1},
+			expectedError: true,
+		},
+		{
+			name:          "empty ALPN protocol",
+			tls:           TLS{ALPN: []string{""}},
+			expectedError: true,
+		},
+		{
+			name:          "invalid HSTS",
+			tls:           TLS{HSTS: HSTS{MaxAge: 300, IncludeSubDomains: true, Preload: true}},
+			expectedError: true,
+		},
+		{
+			name:          "client auth without CA file",
+			tls:           TLS{ClientAuth: ClientAuth{Mode: "require"}},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := parseTLSOptions(tt.tls)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if actual.minVersion != tt.expected.minVersion || actual.maxVersion != tt.expected.maxVersion {
+				t.Errorf("Expected versions %x-%x, got %x-%x", tt.expected.minVersion, tt.expected.maxVersion, actual.minVersion, actual.maxVersion)
+			}
+			if !slices.Equal(actual.cipherSuites, tt.expected.cipherSuites) {
+				t.Errorf("Expected cipher suites %v, got %v", tt.expected.cipherSuites, actual.cipherSuites)
+			}
+			if !slices.Equal(actual.curves, tt.expected.curves) {
+				t.Errorf("Expected curves %v, got %v", tt.expected.curves, actual.curves)
+			}
+			if !slices.Equal(actual.nextProtos, tt.expected.nextProtos) {
+				t.Errorf("Expected ALPN %v, got %v", tt.expected.nextProtos, actual.nextProtos)
+			}
+			if actual.hsts != tt.expected.hsts {
+				t.Errorf("Expected HSTS %q, got %q", tt.expected.hsts, actual.hsts)
+			}
+		})
+	}
+}
+
+func TestHSTSHeader(t *testing.T) {
+	tests := []struct {
+		name          string
+		hsts          HSTS
+		expected      string
+		expectedError bool
+	}{
+		{name: "disabled", hsts: HSTS{}, expected: ""},
+		{name: "max-age", hsts: HSTS{MaxAge: 300}, expected: "max-age=300"},
+		{name: "include subdomains", hsts: HSTS{MaxAge: 300, IncludeSubDomains: true}, expected: "max-age=300; includeSubDomains"},
+		{name: "negative max-age", hsts: HSTS{MaxAge: -1}, expectedError: true},
+		{name: "include subdomains without max-age", hsts: HSTS{IncludeSubDomains: true}, expectedError: true},
+		{name: "preload without include subdomains", hsts: HSTS{MaxAge: 31536000, Preload: true}, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := hstsHeader(tt.hsts)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if actual != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestTicketKeyRotator(t *testing.T) {
+	r := &ticketKeyRotator{configs: []*tls.Config{{}}}
+	for i := 0; i < sessionTicketKeyCount+1; i++ {
+		if err := r.rotate(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if len(r.keys) != sessionTicketKeyCount {
+		t.Errorf("Expected %d keys, got %d", sessionTicketKeyCount, len(r.keys))
+	}
+	if r.keys[0] == r.keys[1] {
+		t.Error("Expected a new key after rotation")
+	}
+}
+
+func TestTLSHardening(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeCertificate(t, dir, "backend", time.Now().Add(time.Hour), "backend.local")
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+
+	c := NewConfig(
+		WithTLS(certPath, keyPath),
+		WithListener(Listener{Address: "127.0.0.1:18444", TLS: true}),
+		WithUpstream(Upstream{HostName: "backend.local", Target: backend.URL}),
+	)
+	c.Proxy.TLS.MinVersion = "1.3"
+	c.Proxy.TLS.SessionTicketKeyRotation = 1000
+	c.Proxy.TLS.HSTS = HSTS{MaxAge: 300}
+
+	gondola, err := NewGondolaFromConfig(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- gondola.Run(ctx)
+	}()
+	waitForServer(t, "127.0.0.1:18444")
+
+	for _, test := range []struct {
+		name          string
+		maxVersion    uint16
+		expectedError bool
+	}{
+		{name: "TLS 1.3", maxVersion: tls.VersionTLS13},
+		{name: "TLS 1.2", maxVersion: tls.VersionTLS12, expectedError: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client := &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{InsecureSkipVerify: true, MaxVersion: test.maxVersion},
+				},
+			}
+			req, err := http.NewRequest(http.MethodGet, "https://127.0.0.1:18444/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = "backend.local"
+			res, err := client.Do(req)
+			if test.expectedError {
+				if err == nil {
+					res.Body.Close()
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if hsts := res.Header.Get("Strict-Transport-Security"); hsts != "max-age=300" {
+				t.Errorf("Expected HSTS header max-age=300, got %q", hsts)
+			}
+		})
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
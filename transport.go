@@ -0,0 +1,126 @@
+package gondola
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// protocolHTTP1 connects to the target with HTTP/1.1 only.
+	protocolHTTP1 = "http1"
+	// protocolH2 connects to an https target with HTTP/2 only.
+	protocolH2 = "h2"
+	// protocolH2C connects to an http target with HTTP/2 over cleartext.
+	protocolH2C = "h2c"
+	// protocolFastCGI connects to a tcp or unix target with FastCGI.
+	protocolFastCGI = "fastcgi"
+)
+
+// newTransport creates the transport used to connect to the target of the upstream.
+// If socketPath is not empty, connections are made to the unix domain socket.
+// The default transport is used if neither a protocol, a TLS configuration nor a socket is set for the target.
+func newTransport(u Upstream, target *url.URL, socketPath string, logger *slog.Logger) (http.RoundTripper, error) {
+	if u.Protocol == protocolFastCGI {
+		t, err := newFastCGITransport(u.FastCGI, target, socketPath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fastcgi upstream %s: %w", u.HostName, err)
+		}
+		return t, nil
+	}
+
+	protocols, err := targetProtocols(u.Protocol, target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid protocol of upstream %s: %w", u.HostName, err)
+	}
+
+	t := u.TargetTLS
+	if t == (TargetTLS{}) && protocols == nil && socketPath == "" {
+		return http.DefaultTransport, nil
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Protocols = protocols
+	if socketPath != "" {
+		tr.DialContext = dialUnix(socketPath)
+	}
+
+	if t != (TargetTLS{}) {
+		cfg, err := newTargetTLSConfig(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target_tls of upstream %s: %w", u.HostName, err)
+		}
+		if t.InsecureSkipVerify {
+			logger.Warn("TLS certificate verification of upstream target is disabled, do not use this in production",
+				slog.String("host_name", u.HostName),
+				slog.String("target", u.Target),
+			)
+		}
+		tr.TLSClientConfig = cfg
+	}
+
+	return tr, nil
+}
+
+// targetProtocols returns the protocols used to connect to the target, or nil to negotiate them by default.
+func targetProtocols(protocol string, target *url.URL) (*http.Protocols, error) {
+	p := new(http.Protocols)
+	switch protocol {
+	case "":
+		return nil, nil
+	case protocolHTTP1:
+		p.SetHTTP1(true)
+	case protocolH2:
+		if target.Scheme != "https" {
+			return nil, fmt.Errorf("%s requires an https target", protocol)
+		}
+		p.SetHTTP2(true)
+	case protocolH2C:
+		if target.Scheme != "http" {
+			return nil, fmt.Errorf("%s requires an http target", protocol)
+		}
+		p.SetUnencryptedHTTP2(true)
+	default:
+		return nil, fmt.Errorf("unsupported protocol: %s", protocol)
+	}
+	return p, nil
+}
+
+// newTargetTLSConfig creates the TLS configuration used to connect to an upstream target.
+func newTargetTLSConfig(t TargetTLS) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify, // #nosec G402 -- opt-in for development, a warning is logged
+	}
+
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(filepath.Clean(t.CAFile))
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file %s: %w", t.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA file %s", t.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if (t.CertPath == "") != (t.KeyPath == "") {
+		return nil, errors.New("cert_path and key_path must be set together")
+	}
+	if t.CertPath != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertPath, t.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate %s: %w", t.CertPath, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,176 @@
+package gondola
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTargetTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey := writeCertificate(t, dir, "backend", time.Now().Add(time.Hour), "backend.local")
+	clientCert, clientKey := writeCertificate(t, dir, "client", time.Now().Add(time.Hour), "client.local")
+
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatalf("Failed to load server certificate: %v", err)
+	}
+	pem, err := os.ReadFile(clientCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(pem)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	tests := []struct {
+		name      string
+		targetTLS TargetTLS
+		code      int
+		body      string
+	}{
+		{
+			name:      "CA file, server name and client certificate",
+			targetTLS: TargetTLS{CAFile: serverCert, ServerName: "backend.local", CertPath: clientCert, KeyPath: clientKey},
+			code:      http.StatusOK,
+			body:      "client",
+		},
+		{
+			name:      "insecure skip verify",
+			targetTLS: TargetTLS{InsecureSkipVerify: true, CertPath: clientCert, KeyPath: clientKey},
+			code:      http.StatusOK,
+			body:      "client",
+		},
+		{
+			name:      "without client certificate",
+			targetTLS: TargetTLS{CAFile: serverCert, ServerName: "backend.local"},
+			code:      http.StatusBadGateway,
+		},
+		{
+			name:      "without CA file",
+			targetTLS: TargetTLS{ServerName: "backend.local", CertPath: clientCert, KeyPath: clientKey},
+			code:      http.StatusBadGateway,
+		},
+		{
+			name:      "server name mismatch",
+			targetTLS: TargetTLS{CAFile: serverCert, ServerName: "other.local", CertPath: clientCert, KeyPath: clientKey},
+			code:      http.StatusBadGateway,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := NewGondolaFromConfig(NewConfig(
+				WithPort("0"),
+				WithUpstream(Upstream{HostName: "api.example.com", Target: backend.URL, TargetTLS: tt.targetTLS}),
+			))
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://api.example.com/", nil)
+			rec := httptest.NewRecorder()
+			g.Handler().ServeHTTP(rec, req)
+
+			if rec.Code != tt.code {
+				t.Errorf("Expected status code %d, got %d", tt.code, rec.Code)
+			}
+			if tt.body != "" && rec.Body.String() != tt.body {
+				t.Errorf("Expected body %s, got %s", tt.body, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestNewTargetTLSConfigError(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeCertificate(t, dir, "client", time.Now().Add(time.Hour), "client.local")
+	invalidPath := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalidPath, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		targetTLS TargetTLS
+	}{
+		{name: "missing CA file", targetTLS: TargetTLS{CAFile: filepath.Join(dir, "missing.pem")}},
+		{name: "invalid CA file", targetTLS: TargetTLS{CAFile: invalidPath}},
+		{name: "cert path without key path", targetTLS: TargetTLS{CertPath: certPath}},
+		{name: "key path without cert path", targetTLS: TargetTLS{KeyPath: keyPath}},
+		{name: "invalid client certificate", targetTLS: TargetTLS{CertPath: invalidPath, KeyPath: keyPath}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newTargetTLSConfig(tt.targetTLS); err == nil {
+				t.Error("Expected error but got none")
+			}
+		})
+	}
+}
+
+func TestTargetProtocols(t *testing.T) {
+	tests := []struct {
+		name          string
+		protocol      string
+		target        string
+		expectedNil   bool
+		http1         bool
+		http2         bool
+		h2c           bool
+		expectedError bool
+	}{
+		{name: "default", target: "http://localhost:8080", expectedNil: true},
+		{name: "http1", protocol: "http1", target: "https://localhost:8443", http1: true},
+		{name: "h2", protocol: "h2", target: "https://localhost:8443", http2: true},
+		{name: "h2c", protocol: "h2c", target: "http://localhost:8080", h2c: true},
+		{name: "h2 with http target", protocol: "h2", target: "http://localhost:8080", expectedError: true},
+		{name: "h2c with https target", protocol: "h2c", target: "https://localhost:8443", expectedError: true},
+		{name: "unsupported protocol", protocol: "h3", target: "https://localhost:8443", expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := url.Parse(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := targetProtocols(tt.protocol, target)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tt.expectedNil {
+				if p != nil {
+					t.Errorf("Expected nil protocols, got %v", p)
+				}
+				return
+			}
+			if p.HTTP1() != tt.http1 || p.HTTP2() != tt.http2 || p.UnencryptedHTTP2() != tt.h2c {
+				t.Errorf("Unexpected protocols %v", p)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package gondola
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// unixScheme is the scheme of unix domain socket addresses such as unix:///run/app.sock.
+const unixScheme = "unix://"
+
+// unixSocketHost is the host of requests sent to unix domain socket targets, which have no host name.
+const unixSocketHost = "localhost"
+
+// unixSocketPath returns the socket path of a unix domain socket address, or false if addr is not one.
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, unixScheme), true
+}
+
+// parseTarget parses the target URL of an upstream.
+// A unix domain socket target is returned as an http URL with the socket path.
+func parseTarget(target string) (*url.URL, string, error) {
+	if path, ok := unixSocketPath(target); ok {
+		if path == "" {
+			return nil, "", errors.New("unix socket path must not be empty")
+		}
+		return &url.URL{Scheme: "http", Host: unixSocketHost}, path, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, "", err
+	}
+	return u, "", nil
+}
+
+// dialUnix returns a DialContext function that connects to the socket path regardless of the address.
+func dialUnix(path string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+}
+
+// parseSocketMode parses the octal permission of a unix domain socket such as "0660".
+func parseSocketMode(mode string) (fs.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0o777 {
+		return 0, fmt.Errorf("invalid socket_mode %q, must be an octal permission such as 0660", mode)
+	}
+	return fs.FileMode(m), nil
+}
+
+// listenUnix listens on the unix domain socket path and sets its permission if mode is not empty.
+// A stale socket left by a previous process is removed, but other files are not.
+func listenUnix(path, mode string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a unix socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if mode == "" {
+		return net.Listen("unix", path)
+	}
+	m, err := parseSocketMode(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	// The socket is created in a private directory and moved to path once its permission is set,
+	// so that it is never reachable with the permission given by the umask.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".gondola-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	ul := ln.(*net.UnixListener)
+	ul.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, m); err != nil {
+		ul.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ul.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: ul, path: path}, nil
+}
+
+// unixListener is a unix domain socket listener that removes the socket at path when it is closed.
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+// Close closes the listener and removes its socket.
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	if rerr := os.Remove(l.path); rerr != nil && !os.IsNotExist(rerr) && err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -0,0 +1,207 @@
+package gondola
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixSocketUpstream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + r.URL.Path))
+	}))
+	backend.Listener = ln
+	backend.Start()
+	defer backend.Close()
+
+	g, err := NewGondolaFromConfig(NewConfig(
+		WithUpstream(Upstream{HostName: "api.example.com", Target: "unix://" + path}),
+	))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://api.example.com/users", nil)
+	rec := httptest.NewRecorder()
+	g.Handler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, rec.Code)
+	}
+	if rec.Body.String() != "api.example.com/users" {
+		t.Errorf("Expected body api.example.com/users, got %s", rec.Body.String())
+	}
+}
+
+func TestRunWithUnixSocketListener(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+
+	path := filepath.Join(t.TempDir(), "gondola.sock")
+	c := NewConfig(
+		WithListener(Listener{Address: "unix://" + path, SocketMode: "0600"}),
+		WithUpstream(Upstream{HostName: "api.example.com", Target: backend.URL}),
+	)
+	g, err := NewGondolaFromConfig(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- g.Run(ctx)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: dialUnix(path)}}
+	var res *http.Response
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		req, err := http.NewRequest(http.MethodGet, "http://api.example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err = client.Do(req)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Server did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "backend" {
+		t.Errorf("Expected body backend, got %s", body)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("Expected socket mode 0600, got %o", fi.Mode().Perm())
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected socket to be removed on shutdown, got %v", err)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+
+	// A stale socket left by a previous process is replaced.
+	stale := filepath.Join(dir, "stale.sock")
+	ln, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = listenUnix(stale, "")
+	if err != nil {
+		t.Fatalf("Expected stale socket to be replaced, got %v", err)
+	}
+
+	// A socket in use is not replaced.
+	if _, err := listenUnix(stale, ""); err == nil {
+		t.Error("Expected error for socket in use but got none")
+	}
+	ln.Close()
+
+	// Other files are not removed.
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(file, ""); err == nil {
+		t.Error("Expected error for regular file but got none")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("Expected regular file to be kept, got %v", err)
+	}
+
+	// A socket with a permission is moved into place once the permission is set.
+	private := filepath.Join(dir, "private.sock")
+	ln, err = listenUnix(private, "0600")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fi, err := os.Stat(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("Expected socket mode 0600, got %o", fi.Mode().Perm())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 { // file and private.sock
+		t.Errorf("Expected no temporary directory to be left, got %d entries", len(entries))
+	}
+	conn, err := net.Dial("unix", private)
+	if err != nil {
+		t.Fatalf("Expected socket to accept connections, got %v", err)
+	}
+	conn.Close()
+	ln.Close()
+	if _, err := os.Stat(private); !os.IsNotExist(err) {
+		t.Errorf("Expected socket to be removed on close, got %v", err)
+	}
+}
+
+func TestParseSocketMode(t *testing.T) {
+	tests := []struct {
+		mode          string
+		expected      os.FileMode
+		expectedError bool
+	}{
+		{mode: "0660", expected: 0o660},
+		{mode: "600", expected: 0o600},
+		{mode: "0999", expectedError: true},
+		{mode: "01777", expectedError: true},
+		{mode: "rw", expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			m, err := parseSocketMode(tt.mode)
+			if tt.expectedError {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if m != tt.expected {
+				t.Errorf("Expected %o, got %o", tt.expected, m)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package gondola
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+)
+
+// Middleware is a function that wraps an http.Handler.
+type Middleware func(http.Handler) http.Handler
+
+// chain wraps h with the given middlewares.
+// The first middleware is the outermost one.
+func chain(h http.Handler, mws []Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// upstream is a backend server that requests are proxied to.
+type upstream struct {
+	config Upstream
+	pool   *targetPool
+	proxy  http.Handler
+
+	mu          sync.RWMutex
+	middlewares []Middleware
+	handler     http.Handler
+}
+
+// newUpstream creates a new upstream from the given configuration.
+func newUpstream(c *Config, u Upstream, budget *retryBudget, logger *slog.Logger) (*upstream, error) {
+	if err := u.ClientAuth.validate(); err != nil {
+		return nil, fmt.Errorf("invalid upstream %s: %w", u.HostName, err)
+	}
+	if err := u.WebSocket.validate(); err != nil {
+		return nil, fmt.Errorf("invalid upstream %s: %w", u.HostName, err)
+	}
+
+	flushInterval, err := parseFlushInterval(u.FlushInterval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %s: %w", u.HostName, err)
+	}
+
+	pool, err := newTargetPool(u, budget, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := &httputil.ReverseProxy{
+		// The scheme and host of the target are set by the pool for each attempt.
+		Director:       disableEventStreamCompression,
+		Transport:      NewLogRoundTripper(pool),
+		FlushInterval:  flushInterval,
+		ModifyResponse: modifyEventStream,
+		ErrorHandler:   handleProxyError,
+	}
+	handler, err := withClientCert(withWebSocket(NewProxyHandler(proxy, logger), u.WebSocket, logger), effectiveClientAuth(c, u))
+	if err != nil {
+		return nil, fmt.Errorf("invalid client_auth of upstream %s: %w", u.HostName, err)
+	}
+
+	return &upstream{
+		config:  u,
+		pool:    pool,
+		proxy:   handler,
+		handler: handler,
+	}, nil
+}
+
+// statusClientClosedRequest is the status logged for requests whose client went away before a response, as in nginx.
+const statusClientClosedRequest = 499
+
+// statusText returns the text of the status code, including statusClientClosedRequest.
+func statusText(code int) string {
+	if code == statusClientClosedRequest {
+		return "Client Closed Request"
+	}
+	return http.StatusText(code)
+}
+
+// handleProxyError responds to requests that could not be proxied.
+// Requests rejected by open circuits or the concurrency limit get 503, and other errors get 502 like httputil.ReverseProxy.
+// Requests cancelled by the client, e.g. while queued by the concurrency limit, are not logged as proxy errors.
+func handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	var coErr *circuitOpenError
+	switch {
+	case errors.As(err, &coErr):
+		writeCircuitOpen(w, coErr)
+	case errors.Is(err, errConcurrencyLimit):
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errors.Is(err, context.Canceled) && r.Context().Err() != nil:
+		w.WriteHeader(statusClientClosedRequest)
+	default:
+		slog.ErrorContext(r.Context(), "http: proxy error: "+err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// use registers middlewares that are applied to requests for this upstream.
+func (u *upstream) use(mws ...Middleware) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.middlewares = append(u.middlewares, mws...)
+	u.handler = chain(u.proxy, u.middlewares)
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.RLock()
+	h := u.handler
+	u.mu.RUnlock()
+	h.ServeHTTP(w, r)
+}
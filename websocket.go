@@ -0,0 +1,169 @@
+package gondola
+
+import (
+	"bufio"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// validate validates the WebSocket configuration.
+func (ws WebSocket) validate() error {
+	if ws.IdleTimeout < 0 || ws.MaxDuration < 0 || ws.MaxConnections < 0 {
+		return errors.New("websocket idle_timeout, max_duration and max_connections must not be negative")
+	}
+	return nil
+}
+
+// isWebSocketUpgrade returns true if the request asks to upgrade to WebSocket.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// withWebSocket returns a handler that applies the limits to WebSocket connections and logs them when they close.
+// Other requests are passed to next as is.
+func withWebSocket(next http.Handler, ws WebSocket, logger *slog.Logger) http.Handler {
+	var conns chan struct{}
+	if ws.MaxConnections > 0 {
+		conns = make(chan struct{}, ws.MaxConnections)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if conns != nil {
+			select {
+			case conns <- struct{}{}:
+				defer func() { <-conns }()
+			default:
+				http.Error(w, "too many WebSocket connections", http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		ww := &wsResponseWriter{ResponseWriter: w, config: ws}
+		next.ServeHTTP(ww, r)
+
+		// The proxy returns once either side of a hijacked connection is closed.
+		if c := ww.conn; c != nil {
+			c.Close()
+			logger.InfoContext(r.Context(), "websocket_closed",
+				slog.String("host", r.Host),
+				slog.String("remote_addr", r.RemoteAddr),
+				slog.String("request_uri", r.URL.String()),
+				slog.Float64("duration", time.Since(c.start).Seconds()),
+				slog.Int64("bytes_received", c.received.Load()),
+				slog.Int64("bytes_sent", c.sent.Load()),
+				slog.String("reason", c.reason()),
+			)
+		}
+	})
+}
+
+// wsResponseWriter is a http.ResponseWriter that wraps the hijacked connection in a wsConn.
+type wsResponseWriter struct {
+	http.ResponseWriter
+	config WebSocket
+	conn   *wsConn
+}
+
+// Hijack takes over the connection and applies the idle timeout and the max duration to it.
+func (w *wsResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.conn = newWSConn(conn, w.config)
+	return w.conn, brw, nil
+}
+
+// Unwrap returns the underlying http.ResponseWriter for http.ResponseController.
+func (w *wsResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// wsConn is a hijacked client connection that counts bytes in each direction.
+type wsConn struct {
+	net.Conn
+	idleTimeout time.Duration
+	start       time.Time
+	lastActive  atomic.Int64
+	received    atomic.Int64
+	sent        atomic.Int64
+	expired     atomic.Bool
+	timer       *time.Timer
+	closeOnce   sync.Once
+}
+
+// newWSConn wraps conn and closes it after the max duration of the configuration.
+func newWSConn(conn net.Conn, ws WebSocket) *wsConn {
+	c := &wsConn{
+		Conn:        conn,
+		idleTimeout: time.Duration(ws.IdleTimeout) * time.Millisecond,
+		start:       time.Now(),
+	}
+	c.extend()
+	if ws.MaxDuration > 0 {
+		c.timer = time.AfterFunc(time.Duration(ws.MaxDuration)*time.Millisecond, func() {
+			c.expired.Store(true)
+			c.Close()
+		})
+	}
+	return c
+}
+
+// extend pushes the deadline back by the idle timeout, as traffic in either direction keeps the connection alive.
+func (c *wsConn) extend() {
+	c.lastActive.Store(time.Now().UnixNano())
+	if c.idleTimeout > 0 {
+		_ = c.Conn.SetDeadline(time.Now().Add(c.idleTimeout))
+	}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.received.Add(int64(n))
+	if n > 0 {
+		c.extend()
+	}
+	return n, err
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.sent.Add(int64(n))
+	if n > 0 {
+		c.extend()
+	}
+	return n, err
+}
+
+func (c *wsConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+// reason returns why the connection was closed.
+func (c *wsConn) reason() string {
+	if c.expired.Load() {
+		return "max_duration"
+	}
+	if c.idleTimeout > 0 && time.Since(time.Unix(0, c.lastActive.Load())) >= c.idleTimeout {
+		return "idle_timeout"
+	}
+	return "closed"
+}
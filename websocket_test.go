@@ -0,0 +1,267 @@
+package gondola
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newUpgradeEchoServer starts a server that switches to the websocket protocol and echoes what it receives.
+func newUpgradeEchoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketUpgrade(r) {
+			w.Write([]byte("ok"))
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("Failed to hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+}
+
+// dialWebSocket sends an upgrade request to addr and returns the upgraded connection.
+func dialWebSocket(t *testing.T, addr string) (net.Conn, *bufio.Reader, int) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: ws.local\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, res.StatusCode
+}
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// newWebSocketProxy starts a proxy to target with the given WebSocket limits.
+func newWebSocketProxy(t *testing.T, target string, ws WebSocket, w io.Writer) *httptest.Server {
+	t.Helper()
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.Transport = NewLogRoundTripper(http.DefaultTransport)
+	logger := slog.New(slog.NewJSONHandler(w, nil))
+	return httptest.NewServer(withWebSocket(NewProxyHandler(proxy, logger), ws, logger))
+}
+
+func TestWebSocketProxy(t *testing.T) {
+	backend := newUpgradeEchoServer(t)
+	defer backend.Close()
+
+	var logs syncBuffer
+	proxy := newWebSocketProxy(t, backend.URL, WebSocket{}, &logs)
+	defer proxy.Close()
+
+	conn, br, code := dialWebSocket(t, proxy.Listener.Addr().String())
+	if code != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status code %d, got %d", http.StatusSwitchingProtocols, code)
+	}
+	conn.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(br, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ping" {
+		t.Errorf("Expected ping, got %s", b)
+	}
+	conn.Close()
+
+	var closed map[string]any
+	deadline := time.Now().Add(2 * time.Second)
+	for closed == nil && time.Now().Before(deadline) {
+		for _, line := range strings.Split(logs.String(), "\n") {
+			var entry map[string]any
+			if json.Unmarshal([]byte(line), &entry) == nil && entry["msg"] == "websocket_closed" {
+				closed = entry
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if closed == nil {
+		t.Fatal("Expected websocket_closed log entry")
+	}
+	if closed["bytes_received"] != float64(4) {
+		t.Errorf("Expected bytes_received 4, got %v", closed["bytes_received"])
+	}
+	if closed["bytes_sent"] != float64(4) {
+		t.Errorf("Expected bytes_sent 4, got %v", closed["bytes_sent"])
+	}
+	if !strings.Contains(logs.String(), `"status":"Switching Protocols"`) {
+		t.Error("Expected access log with status Switching Protocols")
+	}
+}
+
+func TestWebSocketLimits(t *testing.T) {
+	backend := newUpgradeEchoServer(t)
+	defer backend.Close()
+
+	tests := []struct {
+		name       string
+		ws         WebSocket
+		keepAlive  bool
+		expectedBy time.Duration
+		reason     string
+	}{
+		{name: "idle timeout", ws: WebSocket{IdleTimeout: 100}, expectedBy: time.Second, reason: "idle_timeout"},
+		{name: "max duration", ws: WebSocket{IdleTimeout: 200, MaxDuration: 300}, keepAlive: true, expectedBy: time.Second, reason: "max_duration"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs syncBuffer
+			proxy := newWebSocketProxy(t, backend.URL, tt.ws, &logs)
+			defer proxy.Close()
+
+			conn, br, code := dialWebSocket(t, proxy.Listener.Addr().String())
+			defer conn.Close()
+			if code != http.StatusSwitchingProtocols {
+				t.Fatalf("Expected status code %d, got %d", http.StatusSwitchingProtocols, code)
+			}
+
+			stop := make(chan struct{})
+			defer close(stop)
+			if tt.keepAlive {
+				go func() {
+					ticker := time.NewTicker(50 * time.Millisecond)
+					defer ticker.Stop()
+					for {
+						select {
+						case <-stop:
+							return
+						case <-ticker.C:
+							conn.Write([]byte("."))
+						}
+					}
+				}()
+			}
+
+			start := time.Now()
+			conn.SetReadDeadline(start.Add(tt.expectedBy))
+			_, err := io.Copy(io.Discard, br)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatalf("Expected connection to be closed by the proxy, got %v", err)
+			}
+			if elapsed := time.Since(start); elapsed >= tt.expectedBy {
+				t.Errorf("Expected connection to be closed within %s, took %s", tt.expectedBy, elapsed)
+			}
+
+			deadline := time.Now().Add(time.Second)
+			for !strings.Contains(logs.String(), `"reason":"`+tt.reason+`"`) && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if !strings.Contains(logs.String(), `"reason":"`+tt.reason+`"`) {
+				t.Errorf("Expected close reason %s, got logs %s", tt.reason, logs.String())
+			}
+		})
+	}
+}
+
+func TestWebSocketMaxConnections(t *testing.T) {
+	backend := newUpgradeEchoServer(t)
+	defer backend.Close()
+
+	proxy := newWebSocketProxy(t, backend.URL, WebSocket{MaxConnections: 1}, io.Discard)
+	defer proxy.Close()
+
+	conn, _, code := dialWebSocket(t, proxy.Listener.Addr().String())
+	if code != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status code %d, got %d", http.StatusSwitchingProtocols, code)
+	}
+
+	second, _, code := dialWebSocket(t, proxy.Listener.Addr().String())
+	second.Close()
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d, got %d", http.StatusServiceUnavailable, code)
+	}
+
+	// The connection slot is released when the first connection is closed.
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		third, _, code := dialWebSocket(t, proxy.Listener.Addr().String())
+		third.Close()
+		if code == http.StatusSwitchingProtocols {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected status code %d after release, got %d", http.StatusSwitchingProtocols, code)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Requests other than upgrades are not limited.
+	res, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusServiceUnavailable {
+		t.Error("Expected plain request not to be limited")
+	}
+}
+
+func TestWebSocketValidate(t *testing.T) {
+	tests := []struct {
+		name          string
+		ws            WebSocket
+		expectedError bool
+	}{
+		{name: "no limits", ws: WebSocket{}},
+		{name: "limits", ws: WebSocket{IdleTimeout: 60000, MaxDuration: 3600000, MaxConnections: 100}},
+		{name: "negative idle timeout", ws: WebSocket{IdleTimeout: -1}, expectedError: true},
+		{name: "negative max connections", ws: WebSocket{MaxConnections: -1}, expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.ws.validate()
+			if tt.expectedError && err == nil {
+				t.Error("Expected error but got none")
+			}
+			if !tt.expectedError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}